@@ -13,16 +13,37 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/vmware/bosh-photon-cpi/cmd"
 	"github.com/vmware/bosh-photon-cpi/cpi"
+	"github.com/vmware/bosh-photon-cpi/iso9660"
 	ec "github.com/vmware/photon-controller-go-sdk/photon"
 	"io/ioutil"
 	"os"
-	p "path"
 )
 
 const metadataKey = "bosh-cpi"
 
+// Returns how agent settings reach the agent, checking that the config supports it
+func settingsDelivery(config *cpi.Config) (delivery string, err error) {
+	if config.Agent != nil {
+		delivery = config.Agent.SettingsDelivery
+	}
+	switch delivery {
+	case "":
+		return cpi.SettingsDeliveryISO, nil
+	case cpi.SettingsDeliveryISO:
+		return delivery, nil
+	case cpi.SettingsDeliveryRegistry:
+		if config.Registry == nil || config.Registry.Endpoint == "" {
+			return "", cpi.NewBoshError(cpi.CpiError, false,
+				"Agent settings_delivery '%s' requires a registry endpoint", delivery)
+		}
+		return delivery, nil
+	}
+	return "", cpi.NewBoshError(cpi.CpiError, false,
+		"Unknown agent settings_delivery '%s', expected '%s' or '%s'", delivery,
+		cpi.SettingsDeliveryISO, cpi.SettingsDeliveryRegistry)
+}
+
 func getAgentEnvMetadata(ctx *cpi.Context, vmID string) (res *cpi.AgentEnv, err error) {
 	vm, err := ctx.Client.VMs.Get(vmID)
 	if err != nil {
@@ -30,7 +51,7 @@ func getAgentEnvMetadata(ctx *cpi.Context, vmID string) (res *cpi.AgentEnv, err
 	}
 	metadata, ok := vm.Metadata[metadataKey]
 	if !ok {
-		err = fmt.Errorf("No metadata found with key '%s' for vm ID '%s'", metadataKey, vmID)
+		return nil, fmt.Errorf("No metadata found with key '%s' for vm ID '%s'", metadataKey, vmID)
 	}
 	res = &cpi.AgentEnv{}
 	err = json.Unmarshal([]byte(metadata), res)
@@ -43,55 +64,150 @@ func putAgentEnvMetadata(ctx *cpi.Context, vmID string, env *cpi.AgentEnv) (err
 		return
 	}
 	envString := string(envJson[:])
-	metadata := &ec.VmMetadata{map[string]string{metadataKey: envString}}
+	// SetMetadata replaces all metadata on the VM, so keep anything set by set_vm_metadata
+	vm, err := ctx.Client.VMs.Get(vmID)
+	if err != nil {
+		return
+	}
+	metadata := &ec.VmMetadata{Metadata: map[string]string{}}
+	for key, value := range vm.Metadata {
+		metadata.Metadata[key] = value
+	}
+	metadata.Metadata[metadataKey] = envString
 	// Task returns instantly for SetMetadata
 	_, err = ctx.Client.VMs.SetMetadata(vmID, metadata)
 	return
 }
 
-func createEnvISO(env *cpi.AgentEnv, runner cmd.Runner) (path string, err error) {
-	json, err := json.Marshal(env)
+// Contents of openstack/latest/meta_data.json on a config-drive. The agent reads the
+// instance-id, OpenStack tools the uuid, both are the VM ID.
+type configDriveMetadata struct {
+	UUID       string `json:"uuid"`
+	InstanceID string `json:"instance-id"`
+	Name       string `json:"name"`
+	Hostname   string `json:"hostname"`
+}
+
+// Contents of openstack/latest/user_data on a config-drive pointing the agent at the registry.
+// The agent asks the registry for the settings of the instance named by server.name.
+type registryUserData struct {
+	Server struct {
+		Name string `json:"name"`
+	} `json:"server"`
+	Registry struct {
+		Endpoint string `json:"endpoint"`
+	} `json:"registry"`
+}
+
+func newConfigDriveMetadata(env *cpi.AgentEnv) *configDriveMetadata {
+	return &configDriveMetadata{UUID: env.VM.ID, InstanceID: env.VM.ID, Name: env.VM.Name, Hostname: env.VM.Name}
+}
+
+func createEnvISO(env *cpi.AgentEnv, format string) (path string, err error) {
+	envJson, err := json.Marshal(env)
 	if err != nil {
 		return
 	}
-	envDir, err := ioutil.TempDir("", "agent-iso-dir")
+	legacy := format == "" || format == cpi.SettingsFormatEnv || format == cpi.SettingsFormatBoth
+	configDrive := format == cpi.SettingsFormatConfigDrive || format == cpi.SettingsFormatBoth
+	if !legacy && !configDrive {
+		return "", cpi.NewBoshError(cpi.CpiError, false,
+			"Unknown agent settings_format '%s', expected one of '%s', '%s' or '%s'", format,
+			cpi.SettingsFormatEnv, cpi.SettingsFormatConfigDrive, cpi.SettingsFormatBoth)
+	}
+
+	iso := iso9660.NewWriter()
+	if legacy {
+		// Name of the environment JSON file should be "env" to fit ISO 9660 8.3 filename scheme
+		err = iso.AddFile("env", envJson)
+		if err != nil {
+			return
+		}
+	}
+	if configDrive {
+		// The agent finds config-drives by their label
+		iso.VolumeID = "config-2"
+		metadata, err := json.Marshal(newConfigDriveMetadata(env))
+		if err != nil {
+			return "", err
+		}
+		err = iso.AddFile("openstack/latest/meta_data.json", metadata)
+		if err != nil {
+			return "", err
+		}
+		// User data carries the same settings as the env file
+		err = iso.AddFile("openstack/latest/user_data", envJson)
+		if err != nil {
+			return "", err
+		}
+	}
+	return writeEnvISO(iso)
+}
+
+// Creates a config-drive that only tells the agent where the registry is
+func createRegistryISO(env *cpi.AgentEnv, endpoint string) (path string, err error) {
+	metadata, err := json.Marshal(newConfigDriveMetadata(env))
 	if err != nil {
 		return
 	}
-	// Name of the environment JSON file should be "env" to fit ISO 9660 8.3 filename scheme
-	envFile, err := os.Create(p.Join(envDir, "env"))
+	userData := &registryUserData{}
+	// The registry looks settings up by VM ID, VM names aren't unique
+	userData.Server.Name = env.VM.ID
+	userData.Registry.Endpoint = endpoint
+	userDataJson, err := json.Marshal(userData)
 	if err != nil {
 		return
 	}
-	_, err = envFile.Write(json)
+
+	iso := iso9660.NewWriter()
+	iso.VolumeID = "config-2"
+	err = iso.AddFile("openstack/latest/meta_data.json", metadata)
 	if err != nil {
 		return
 	}
-	err = envFile.Close()
+	err = iso.AddFile("openstack/latest/user_data", userDataJson)
 	if err != nil {
 		return
 	}
+	return writeEnvISO(iso)
+}
 
+func writeEnvISO(iso *iso9660.Writer) (path string, err error) {
 	envISO, err := ioutil.TempFile("", "agent-env-iso")
 	if err != nil {
 		return
 	}
-	envISO.Close()
-	output, err := runner.Run("mkisofs", "-o", envISO.Name(), envFile.Name())
+	_, err = iso.WriteTo(envISO)
+	closeErr := envISO.Close()
+	if err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		out := string(output[:])
-		return "", errors.New(fmt.Sprintf("Failed to generate ISO for agent settings: %v\n%s", err, out))
+		// Don't leave a partially written ISO behind
+		_ = os.Remove(envISO.Name())
+		return "", errors.New(fmt.Sprintf("Failed to generate ISO for agent settings: %v", err))
 	}
-	// Cleanup temp dir but ignore the error. Failure to delete a temp file is not
-	// worth worrying about.
-	_ = os.RemoveAll(envDir)
 	return envISO.Name(), nil
 }
 
-// Creates agent env ISO, updates VM metadata, and attaches the ISO to VM
+// Creates agent env ISO, updates VM metadata, and attaches the ISO to VM.
+// When settings are delivered by the registry only the metadata is updated.
 func updateAgentEnv(ctx *cpi.Context, vmID string, env *cpi.AgentEnv) (err error) {
 	ctx.Logger.Infof("Creating agent env: %#v", env)
-	isoPath, err := createEnvISO(env, ctx.Runner)
+	delivery, err := settingsDelivery(ctx.Config)
+	if err != nil {
+		return
+	}
+	if delivery == cpi.SettingsDeliveryRegistry {
+		ctx.Logger.Info("Updating metadata for VM")
+		return putAgentEnvMetadata(ctx, vmID, env)
+	}
+
+	format := ""
+	if ctx.Config.Agent != nil {
+		format = ctx.Config.Agent.SettingsFormat
+	}
+	isoPath, err := createEnvISO(env, format)
 	if err != nil {
 		return
 	}
@@ -103,13 +219,27 @@ func updateAgentEnv(ctx *cpi.Context, vmID string, env *cpi.AgentEnv) (err error
 	if err != nil {
 		return
 	}
+	return attachEnvISO(ctx, vmID, isoPath)
+}
+
+// Attaches the config-drive pointing a new VM at the registry. The ISO never changes
+// afterwards, the registry serves the current settings from VM metadata.
+func attachRegistryISO(ctx *cpi.Context, vmID string, env *cpi.AgentEnv) (err error) {
+	isoPath, err := createRegistryISO(env, ctx.Config.Registry.Endpoint)
+	if err != nil {
+		return
+	}
+	defer os.Remove(isoPath)
+	return attachEnvISO(ctx, vmID, isoPath)
+}
 
+func attachEnvISO(ctx *cpi.Context, vmID string, isoPath string) (err error) {
 	// Detach ISO first, but ignore any task error due to ISO already being detached
 	detachTask, err := ctx.Client.VMs.DetachISO(vmID)
 	if err != nil && !isTaskError(err) {
 		return err
 	}
-	detachTask, err = ctx.Client.Tasks.Wait(detachTask.ID)
+	detachTask, err = waitForTask(ctx, detachTask.ID)
 	if err != nil && !isTaskError(err) {
 		return err
 	}
@@ -120,6 +250,6 @@ func updateAgentEnv(ctx *cpi.Context, vmID string, env *cpi.AgentEnv) (err error
 		return
 	}
 	ctx.Logger.Infof("Waiting on task: %#v", attachTask)
-	attachTask, err = ctx.Client.Tasks.Wait(attachTask.ID)
+	attachTask, err = waitForTask(ctx, attachTask.ID)
 	return
 }
@@ -0,0 +1,153 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	"net"
+	"sort"
+)
+
+func invalidSettings(format string, args ...interface{}) error {
+	return cpi.NewBoshError(cpi.CpiError, false, "Invalid agent settings: "+format, args...)
+}
+
+// The networks from the director are checked by create_vm for mistakes the agent would
+// otherwise only hit after the VM boots, when the only symptom is an unresponsive agent.
+// The rest of the agent settings are built by the CPI itself. Settings of existing VMs
+// aren't checked again, so disks can still be attached to VMs created before.
+func validateNetworks(networks map[string]interface{}) (err error) {
+	names := []string{}
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	gatewayNetworks := []string{}
+	routedNetworks := 0
+	for _, name := range names {
+		network, err := parseNetwork(networks[name])
+		if err != nil {
+			return invalidSettings("networks.%s: %v", name, err)
+		}
+		switch network.Type {
+		case "", "manual":
+			err = validateManualNetwork(name, network)
+		case "dynamic":
+		case "vip":
+			if net.ParseIP(network.IP) == nil {
+				err = invalidSettings("networks.%s.ip '%s' is not an IP address", name, network.IP)
+			}
+		default:
+			err = invalidSettings(
+				"networks.%s.type '%s' is not one of manual, dynamic or vip", name, network.Type)
+		}
+		if err != nil {
+			return err
+		}
+		if network.Type != "vip" {
+			routedNetworks++
+		}
+
+		for i, dns := range network.DNS {
+			if net.ParseIP(dns) == nil {
+				return invalidSettings("networks.%s.dns[%d] '%s' is not an IP address", name, i, dns)
+			}
+		}
+		for i, property := range network.Default {
+			switch property {
+			case "gateway":
+				gatewayNetworks = append(gatewayNetworks, name)
+			case "dns":
+			default:
+				return invalidSettings(
+					"networks.%s.default[%d] '%s' is not one of dns or gateway", name, i, property)
+			}
+		}
+	}
+
+	if len(gatewayNetworks) > 1 {
+		return invalidSettings(
+			"networks %v all have 'gateway' in default, exactly one network must", gatewayNetworks)
+	}
+	// The director only leaves out defaults when there is a single network
+	if len(gatewayNetworks) == 0 && routedNetworks > 1 {
+		return invalidSettings("no network has 'gateway' in default, exactly one network must")
+	}
+	return nil
+}
+
+func parseNetwork(settings interface{}) (network *cpi.Network, err error) {
+	if _, ok := settings.(map[string]interface{}); !ok {
+		return nil, errors.New("network settings must be a map")
+	}
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return
+	}
+	network = &cpi.Network{}
+	err = json.Unmarshal(data, network)
+	return
+}
+
+func validateManualNetwork(name string, network *cpi.Network) error {
+	ip := net.ParseIP(network.IP)
+	if ip == nil {
+		return invalidSettings("networks.%s.ip '%s' is not an IP address", name, network.IP)
+	}
+	mask, err := parseNetmask(network.Netmask, ip)
+	if err != nil {
+		return invalidSettings("networks.%s.netmask '%s' %v", name, network.Netmask, err)
+	}
+	subnet := &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+
+	if network.Gateway == "" {
+		for _, property := range network.Default {
+			if property == "gateway" {
+				return invalidSettings("networks.%s.gateway is required for the default gateway network", name)
+			}
+		}
+		return nil
+	}
+	gateway := net.ParseIP(network.Gateway)
+	if gateway == nil {
+		return invalidSettings("networks.%s.gateway '%s' is not an IP address", name, network.Gateway)
+	}
+	if !subnet.Contains(gateway) {
+		return invalidSettings(
+			"networks.%s.gateway '%s' is not in subnet %s of the network's ip and netmask",
+			name, network.Gateway, subnet)
+	}
+	if gateway.Equal(ip) {
+		return invalidSettings("networks.%s.ip '%s' is the same as the gateway", name, network.IP)
+	}
+	return nil
+}
+
+// Parses a dotted netmask, which has to be of the same address family as ip
+func parseNetmask(netmask string, ip net.IP) (mask net.IPMask, err error) {
+	parsed := net.ParseIP(netmask)
+	if parsed == nil {
+		return nil, errors.New("is not a netmask")
+	}
+	if ip.To4() != nil {
+		parsed = parsed.To4()
+		if parsed == nil {
+			return nil, errors.New("is not an IPv4 netmask")
+		}
+	}
+	mask = net.IPMask(parsed)
+	if _, bits := mask.Size(); bits == 0 {
+		return nil, errors.New("has non-contiguous bits")
+	}
+	return
+}
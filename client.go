@@ -0,0 +1,230 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	"github.com/vmware/bosh-photon-cpi/logger"
+	"github.com/vmware/photon-controller-go-sdk/photon"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Creates a photon client for the given config. When a user/password or refresh token
+// is configured, the client logs in through the photon auth service and logs in again
+// if photon rejects the access token. With a zero reloginInterval that happens at most
+// once, which is what a CPI action gets. Long running processes pass an interval so
+// they keep getting fresh tokens.
+func newPhotonClient(cpiConfig *cpi.Config, log logger.Logger, reloginInterval time.Duration) (client *photon.Client, err error) {
+	config := cpiConfig.Photon
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return
+	}
+	options := &photon.ClientOptions{
+		IgnoreCertificate: config.IgnoreCertificate,
+		RootCAs:           tlsConfig.RootCAs,
+		TokenOptions:      &photon.TokenOptions{AccessToken: config.Token},
+	}
+	if cpiConfig.Tasks != nil {
+		options.TaskPollTimeout = time.Duration(cpiConfig.Tasks.PollTimeout)
+		options.TaskPollDelay = time.Duration(cpiConfig.Tasks.PollDelay)
+		options.TaskRetryCount = cpiConfig.Tasks.RetryCount
+	}
+	// The SDK's own transport has no client certificate support, so always use ours
+	var transport http.RoundTripper = &http.Transport{TLSClientConfig: tlsConfig}
+	transport = newRetryTransport(transport, cpiConfig.Retry, log)
+	if config.User == "" && config.RefreshToken == "" {
+		return newClientWithTransport(config.Target, "", options, transport), nil
+	}
+
+	// Ask photon where its auth service lives
+	infoClient := newClientWithTransport(config.Target, config.Target, options, transport)
+	authInfo, err := infoClient.Auth.Get()
+	if err != nil {
+		return
+	}
+	if !authInfo.Enabled {
+		log.Info("Authentication is not enabled on photon, ignoring credentials")
+		return newClientWithTransport(config.Target, "", options, transport), nil
+	}
+	authEndpoint := "https://" + authInfo.Endpoint
+	if authInfo.Port != 0 {
+		authEndpoint = fmt.Sprintf("%s:%d", authEndpoint, authInfo.Port)
+	}
+
+	authClient := newClientWithTransport(config.Target, authEndpoint, options, transport)
+	login := func() (tokens *photon.TokenOptions, err error) {
+		if config.RefreshToken != "" {
+			log.Info("Logging in to photon with refresh token")
+			return getTokensByRefreshToken(&http.Client{Transport: transport}, authEndpoint, config.RefreshToken)
+		}
+		// The SDK puts credentials into the form body as is, so escape them here
+		log.Infof("Logging in to photon as user '%s'", config.User)
+		return authClient.Auth.GetTokensByPassword(url.QueryEscape(config.User), url.QueryEscape(config.Password))
+	}
+	tokens, err := login()
+	if err != nil {
+		return
+	}
+
+	options.TokenOptions = tokens
+	authTransport := &authTransport{
+		transport:       transport,
+		login:           login,
+		accessToken:     tokens.AccessToken,
+		reloginInterval: reloginInterval,
+		logger:          log,
+	}
+	return newClientWithTransport(config.Target, authEndpoint, options, authTransport), nil
+}
+
+// Creates a photon client that sends its requests through the given transport. The SDK's
+// NewTestClient is meant for mocking out HTTP, but it is the only constructor that takes an
+// http.Client, which the CPI needs for client certificates, retries and logging in again.
+// NewClient would silently drop all three.
+func newClientWithTransport(target, authEndpoint string, options *photon.ClientOptions, transport http.RoundTripper) *photon.Client {
+	return photon.NewTestClient(target, authEndpoint, options, &http.Client{Transport: transport})
+}
+
+// Gets tokens for a refresh token from the photon auth service. The SDK's
+// GetTokensByRefreshToken sends grant_type=prefresh_token, which auth servers reject,
+// so the refresh grant is posted here.
+func getTokensByRefreshToken(httpClient *http.Client, authEndpoint string, refreshToken string) (tokens *photon.TokenOptions, err error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+	form.Set("scope", "openid offline_access")
+	res, err := httpClient.PostForm(authEndpoint+"/openidconnect/token", form)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		apiErr := photon.ApiError{HttpStatusCode: res.StatusCode}
+		json.NewDecoder(res.Body).Decode(&apiErr)
+		return nil, apiErr
+	}
+	tokens = &photon.TokenOptions{}
+	err = json.NewDecoder(res.Body).Decode(tokens)
+	return
+}
+
+// Builds the TLS config for talking to photon. Without a CA bundle the system roots are used.
+func newTLSConfig(config *cpi.PhotonConfig) (tlsConfig *tls.Config, err error) {
+	tlsConfig = &tls.Config{InsecureSkipVerify: config.IgnoreCertificate}
+
+	caCert := []byte(config.CACert)
+	if config.CACertFile != "" {
+		fileCert, err := ioutil.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, cpi.NewCpiError(err, "Unable to read CA certificate file '%s'", config.CACertFile)
+		}
+		caCert = append(append(caCert, '\n'), fileCert...)
+	}
+	if len(bytes.TrimSpace(caCert)) > 0 {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, cpi.NewCpiError(
+				"no PEM encoded certificates found", "Invalid CA certificate bundle in photon ca_cert/ca_cert_file")
+		}
+	}
+
+	if config.ClientCert != "" || config.ClientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(config.ClientCert), []byte(config.ClientKey))
+		if err != nil {
+			return nil, cpi.NewCpiError(err, "Invalid client certificate or key in photon client_cert/client_key")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
+// Round tripper that authorizes requests with the current access token. On HTTP 401
+// it logs in again and repeats the rejected request with the new token. Without a
+// reloginInterval only the first 401 leads to a login, with one logins are at least
+// that far apart, so a token photon keeps rejecting never turns into a login loop.
+type authTransport struct {
+	transport       http.RoundTripper
+	login           func() (*photon.TokenOptions, error)
+	accessToken     string
+	reloginInterval time.Duration
+	loggedIn        bool
+	lastLogin       time.Time
+	logger          logger.Logger
+	mutex           sync.Mutex
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (res *http.Response, err error) {
+	t.mutex.Lock()
+	token := t.accessToken
+	t.mutex.Unlock()
+
+	res, err = t.transport.RoundTrip(authorize(req, token))
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return
+	}
+	// Requests with a body that can't be read again, e.g. stemcell uploads, can't be repeated
+	if req.Body != nil && req.GetBody == nil {
+		return
+	}
+
+	token, ok := t.relogin(token)
+	if !ok {
+		return
+	}
+	retry := authorize(req, token)
+	if req.GetBody != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return
+		}
+	}
+	res.Body.Close()
+	return t.transport.RoundTrip(retry)
+}
+
+// Logs in again unless another request already did so after rejectedToken was issued.
+func (t *authTransport) relogin(rejectedToken string) (token string, ok bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.accessToken != rejectedToken {
+		return t.accessToken, true
+	}
+	if t.loggedIn && (t.reloginInterval == 0 || time.Since(t.lastLogin) < t.reloginInterval) {
+		return "", false
+	}
+	t.loggedIn = true
+	t.lastLogin = time.Now()
+
+	t.logger.Info("Photon rejected the access token, logging in again")
+	tokens, err := t.login()
+	if err != nil {
+		t.logger.Errorf("Unable to log in to photon again: %v", err)
+		return "", false
+	}
+	t.accessToken = tokens.AccessToken
+	return t.accessToken, true
+}
+
+// Returns a copy of req that uses the given access token
+func authorize(req *http.Request, token string) *http.Request {
+	r := req.Clone(req.Context())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
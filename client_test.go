@@ -0,0 +1,289 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	"github.com/vmware/bosh-photon-cpi/logger"
+	. "github.com/vmware/bosh-photon-cpi/mocks"
+	ec "github.com/vmware/photon-controller-go-sdk/photon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Photon client", func() {
+	var (
+		server        *httptest.Server
+		config        *cpi.PhotonConfig
+		log           logger.Logger
+		authEnabled   bool
+		logins        int
+		forms         []url.Values
+		validToken    string
+		rejectedCalls int
+		mutex         sync.Mutex
+	)
+
+	BeforeEach(func() {
+		authEnabled = true
+		logins = 0
+		forms = []url.Values{}
+		validToken = ""
+		rejectedCalls = 0
+		log = logger.New()
+
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			switch r.URL.Path {
+			case "/auth":
+				host, port, _ := parseHostPort(server.URL)
+				fmt.Fprint(w, ToJson(&ec.AuthInfo{Enabled: authEnabled, Endpoint: host, Port: port}))
+			case "/openidconnect/token":
+				r.ParseForm()
+				forms = append(forms, r.PostForm)
+				logins++
+				validToken = "token-" + strconv.Itoa(logins)
+				fmt.Fprint(w, ToJson(&ec.TokenOptions{AccessToken: validToken}))
+			case "/vms/fake-vm-id":
+				if validToken != "" && r.Header.Get("Authorization") != "Bearer "+validToken {
+					rejectedCalls++
+					w.WriteHeader(http.StatusUnauthorized)
+					fmt.Fprint(w, ToJson(&ec.ApiError{Code: "Unauthorized"}))
+					return
+				}
+				fmt.Fprint(w, ToJson(&ec.VM{ID: "fake-vm-id"}))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		config = &cpi.PhotonConfig{
+			Target:            server.URL,
+			IgnoreCertificate: true,
+			User:              "fake-user",
+			Password:          "fake p@ss&word",
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("uses the configured token when no credentials are given", func() {
+		config.User = ""
+		config.Password = ""
+		config.Token = "fake-token"
+		client, err := newPhotonClient(&cpi.Config{Photon: config}, log, 0)
+
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(client.Endpoint).Should(Equal(server.URL))
+		Expect(logins).Should(Equal(0))
+	})
+	It("logs in with user and password", func() {
+		client, err := newPhotonClient(&cpi.Config{Photon: config}, log, 0)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(logins).Should(Equal(1))
+		Expect(forms[0].Get("grant_type")).Should(Equal("password"))
+		Expect(forms[0].Get("username")).Should(Equal("fake-user"))
+		Expect(forms[0].Get("password")).Should(Equal("fake p@ss&word"))
+
+		vm, err := client.VMs.Get("fake-vm-id")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(vm.ID).Should(Equal("fake-vm-id"))
+		Expect(log.LogData()).ShouldNot(ContainSubstring("p@ss"))
+	})
+	It("logs in with a refresh token", func() {
+		config.User = ""
+		config.Password = ""
+		config.RefreshToken = "fake-refresh-token"
+		_, err := newPhotonClient(&cpi.Config{Photon: config}, log, 0)
+
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(logins).Should(Equal(1))
+		Expect(forms[0].Get("grant_type")).Should(Equal("refresh_token"))
+		Expect(forms[0].Get("refresh_token")).Should(Equal("fake-refresh-token"))
+		Expect(forms[0].Get("scope")).Should(Equal("openid offline_access"))
+		Expect(log.LogData()).ShouldNot(ContainSubstring("fake-refresh-token"))
+	})
+	It("ignores credentials when auth is disabled", func() {
+		authEnabled = false
+		client, err := newPhotonClient(&cpi.Config{Photon: config}, log, 0)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(logins).Should(Equal(0))
+
+		_, err = client.VMs.Get("fake-vm-id")
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+	It("logs in again once when the token is rejected", func() {
+		client, err := newPhotonClient(&cpi.Config{Photon: config}, log, 0)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		// Expire the token issued at login
+		mutex.Lock()
+		validToken = "expired"
+		mutex.Unlock()
+
+		vm, err := client.VMs.Get("fake-vm-id")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(vm.ID).Should(Equal("fake-vm-id"))
+		Expect(logins).Should(Equal(2))
+		Expect(rejectedCalls).Should(Equal(1))
+
+		// Only one login is attempted, further rejections are returned
+		mutex.Lock()
+		validToken = "expired"
+		mutex.Unlock()
+
+		_, err = client.VMs.Get("fake-vm-id")
+		Expect(err).Should(HaveOccurred())
+		apiErr, ok := err.(ec.ApiError)
+		Expect(ok).Should(BeTrue())
+		Expect(apiErr.HttpStatusCode).Should(Equal(http.StatusUnauthorized))
+		Expect(logins).Should(Equal(2))
+		Expect(log.LogData()).ShouldNot(ContainSubstring("p@ss"))
+	})
+
+	It("keeps logging in again with a relogin interval", func() {
+		client, err := newPhotonClient(&cpi.Config{Photon: config}, log, time.Millisecond)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		for i := 0; i < 2; i++ {
+			mutex.Lock()
+			validToken = "expired"
+			mutex.Unlock()
+			time.Sleep(2 * time.Millisecond)
+
+			_, err = client.VMs.Get("fake-vm-id")
+			Expect(err).ShouldNot(HaveOccurred())
+		}
+		Expect(logins).Should(Equal(3))
+		Expect(rejectedCalls).Should(Equal(2))
+	})
+
+	Describe("TLS config", func() {
+		var (
+			caCert string
+		)
+
+		BeforeEach(func() {
+			config.IgnoreCertificate = false
+			caCert = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+		})
+
+		It("verifies photon with an inline CA bundle", func() {
+			config.CACert = caCert
+			client, err := newPhotonClient(&cpi.Config{Photon: config}, log, 0)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			_, err = client.VMs.Get("fake-vm-id")
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		It("verifies photon with a CA file", func() {
+			caFile, err := ioutil.TempFile("", "bosh-photon-cpi-ca")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer os.Remove(caFile.Name())
+			caFile.WriteString(caCert)
+			caFile.Close()
+
+			config.CACertFile = caFile.Name()
+			client, err := newPhotonClient(&cpi.Config{Photon: config}, log, 0)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			_, err = client.VMs.Get("fake-vm-id")
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		It("fails verification without the CA bundle", func() {
+			_, err := newPhotonClient(&cpi.Config{Photon: config}, log, 0)
+			Expect(err).Should(HaveOccurred())
+		})
+		It("returns a CpiError for a malformed CA bundle", func() {
+			config.CACert = "-----BEGIN CERTIFICATE-----\nnot a cert\n-----END CERTIFICATE-----"
+			_, err := newPhotonClient(&cpi.Config{Photon: config}, log, 0)
+
+			Expect(err).Should(HaveOccurred())
+			boshErr, ok := err.(cpi.BoshError)
+			Expect(ok).Should(BeTrue())
+			Expect(boshErr.Type()).Should(Equal(cpi.CpiError))
+			Expect(err.Error()).Should(ContainSubstring("ca_cert"))
+		})
+		It("returns a CpiError for a missing CA file", func() {
+			config.CACertFile = "/does/not/exist"
+			_, err := newPhotonClient(&cpi.Config{Photon: config}, log, 0)
+
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring("/does/not/exist"))
+		})
+		It("loads a client certificate for mutual TLS", func() {
+			config.ClientCert, config.ClientKey = newTestKeyPair()
+			tlsConfig, err := newTLSConfig(config)
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(tlsConfig.Certificates).Should(HaveLen(1))
+		})
+		It("returns a CpiError for a client certificate without a key", func() {
+			config.ClientCert, _ = newTestKeyPair()
+			_, err := newTLSConfig(config)
+
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring("client_key"))
+		})
+	})
+})
+
+// Generates a self-signed PEM encoded certificate and key
+func newTestKeyPair() (certPEM string, keyPEM string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "bosh-photon-cpi"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return
+}
+
+func parseHostPort(rawURL string) (host string, port int, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return
+	}
+	port, err = strconv.Atoi(u.Port())
+	return u.Hostname(), port, err
+}
@@ -10,7 +10,10 @@
 package main
 
 import (
+	"github.com/vmware/bosh-photon-cpi/cpi"
 	. "github.com/vmware/photon-controller-go-sdk/photon"
+	"net/http"
+	"time"
 )
 
 // Indicates whether or not an error is of type photon.TaskError
@@ -20,3 +23,50 @@ func isTaskError(e error) bool {
 	}
 	return false
 }
+
+// Indicates whether or not an error is a photon API error for an entity that doesn't exist
+func isNotFoundError(e error) bool {
+	if apiErr, ok := e.(ApiError); ok && apiErr.HttpStatusCode == http.StatusNotFound {
+		return true
+	}
+	return false
+}
+
+// Indicates whether the director passes persistent disk hints to the agent itself,
+// which is the case when both the CPI and stemcell API versions are 2 or later.
+// The agent env then doesn't need to be rewritten for disk changes.
+func isAgentEnvDiskManagedByDirector(ctx *cpi.Context) bool {
+	return ctx.ApiVersion >= 2 && ctx.RequestContext.VM.Stemcell.ApiVersion >= 2
+}
+
+// Waits for a photon task using the poll timeout configured for the current action.
+// Timeouts are reported with the action and task so stuck tasks are easy to find.
+func waitForTask(ctx *cpi.Context, taskID string) (task *Task, err error) {
+	timeout := taskTimeout(ctx)
+	if timeout > 0 {
+		task, err = ctx.Client.Tasks.WaitTimeout(taskID, timeout)
+	} else {
+		task, err = ctx.Client.Tasks.Wait(taskID)
+	}
+	if _, ok := err.(TaskTimeoutError); ok {
+		if timeout > 0 {
+			err = cpi.NewBoshError(cpi.CloudError, true,
+				"Action '%s' timed out after %v waiting for task '%s'", ctx.Action, timeout, taskID)
+		} else {
+			err = cpi.NewBoshError(cpi.CloudError, true,
+				"Action '%s' timed out waiting for task '%s'", ctx.Action, taskID)
+		}
+	}
+	return
+}
+
+// Returns the poll timeout for the current action, or 0 to use the client's default
+func taskTimeout(ctx *cpi.Context) time.Duration {
+	if ctx.Config == nil || ctx.Config.Tasks == nil {
+		return 0
+	}
+	if timeout, ok := ctx.Config.Tasks.ActionTimeouts[ctx.Action]; ok {
+		return time.Duration(timeout)
+	}
+	return time.Duration(ctx.Config.Tasks.PollTimeout)
+}
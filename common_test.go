@@ -0,0 +1,98 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	"github.com/vmware/bosh-photon-cpi/logger"
+	. "github.com/vmware/bosh-photon-cpi/mocks"
+	ec "github.com/vmware/photon-controller-go-sdk/photon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("Common", func() {
+	var (
+		server *httptest.Server
+		ctx    *cpi.Context
+	)
+
+	BeforeEach(func() {
+		server = NewMockServer()
+		Activate(true)
+		httpClient := &http.Client{Transport: DefaultMockTransport}
+		options := &ec.ClientOptions{TaskPollDelay: time.Millisecond}
+		ctx = &cpi.Context{
+			Client: ec.NewTestClient(server.URL, "", options, httpClient),
+			Config: &cpi.Config{
+				Photon: &cpi.PhotonConfig{
+					Target:    server.URL,
+					ProjectID: "fake-project-id",
+				},
+				Tasks: &cpi.TasksConfig{
+					PollTimeout: cpi.Duration(time.Hour),
+					ActionTimeouts: map[string]cpi.Duration{
+						"detach_disk": cpi.Duration(10 * time.Millisecond),
+					},
+				},
+			},
+			Logger: logger.New(),
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Describe("waitForTask", func() {
+		It("returns the completed task", func() {
+			completedTask := &ec.Task{Operation: "DETACH_DISK", State: "COMPLETED", ID: "fake-task-id"}
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+completedTask.ID,
+				CreateResponder(200, ToJson(completedTask)))
+
+			ctx.Action = "detach_disk"
+			task, err := waitForTask(ctx, "fake-task-id")
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(task.State).Should(Equal("COMPLETED"))
+		})
+		It("names the action and task when the action timeout is reached", func() {
+			queuedTask := &ec.Task{Operation: "DETACH_DISK", State: "QUEUED", ID: "fake-task-id"}
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+queuedTask.ID,
+				CreateResponder(200, ToJson(queuedTask)))
+
+			ctx.Action = "detach_disk"
+			_, err := waitForTask(ctx, "fake-task-id")
+
+			Expect(err).Should(HaveOccurred())
+			boshErr, ok := err.(cpi.BoshError)
+			Expect(ok).Should(BeTrue())
+			Expect(boshErr.Type()).Should(Equal(cpi.CloudError))
+			Expect(boshErr.CanRetry()).Should(BeTrue())
+			Expect(err.Error()).Should(ContainSubstring("detach_disk"))
+			Expect(err.Error()).Should(ContainSubstring("fake-task-id"))
+		})
+		It("uses the action timeout over the poll timeout", func() {
+			ctx.Action = "detach_disk"
+			Expect(taskTimeout(ctx)).Should(Equal(10 * time.Millisecond))
+			ctx.Action = "create_vm"
+			Expect(taskTimeout(ctx)).Should(Equal(time.Hour))
+			ctx.Config.Tasks = nil
+			Expect(taskTimeout(ctx)).Should(Equal(time.Duration(0)))
+		})
+	})
+})
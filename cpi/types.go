@@ -10,36 +10,147 @@
 package cpi
 
 import (
+	"encoding/json"
 	"fmt"
-	"github.com/vmware/bosh-photon-cpi/cmd"
 	"github.com/vmware/bosh-photon-cpi/logger"
 	"github.com/vmware/photon-controller-go-sdk/photon"
+	"time"
 )
 
 type Context struct {
 	Client *photon.Client
 	Config *Config
-	Runner cmd.Runner
 	Logger logger.Logger
+
+	// Name of the CPI action being run, e.g. "create_vm"
+	Action string
+
+	// CPI API version negotiated with the director for the current request
+	ApiVersion int
+	// Context block sent by the director with the current request
+	RequestContext RequestContext
 }
 
 type Config struct {
-	Photon *PhotonConfig `json:"photon"`
-	Agent  *AgentConfig  `json:"agent"`
+	Photon   *PhotonConfig   `json:"photon"`
+	Agent    *AgentConfig    `json:"agent"`
+	Metadata *MetadataConfig `json:"metadata"`
+	Tasks    *TasksConfig    `json:"tasks"`
+	Retry    *RetryConfig    `json:"retry"`
+	Debug    *DebugConfig    `json:"debug"`
+	Registry *RegistryConfig `json:"registry"`
+}
+
+// Settings server run with the -registry flag, used with SettingsDeliveryRegistry
+type RegistryConfig struct {
+	// Listen address of the registry, e.g. ":25777"
+	Address string `json:"address"`
+	// URL agents use to reach the registry, including the credentials
+	Endpoint string `json:"endpoint"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	// Certificate and key files to serve HTTPS with. Without them settings, including the
+	// credentials in them, travel in plaintext.
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+}
+
+type DebugConfig struct {
+	// Leave VMs that fail during create_vm in place instead of deleting them
+	KeepFailedVMs bool `json:"keep_failed_vms"`
+}
+
+// Controls retries of photon requests that fail with transient errors. Zero values use
+// the CPI defaults.
+type RetryConfig struct {
+	// Total number of attempts per request, 1 disables retries
+	MaxAttempts    int      `json:"max_attempts"`
+	InitialBackoff Duration `json:"initial_backoff"`
+	MaxBackoff     Duration `json:"max_backoff"`
+	// Fraction of the backoff that is randomly added or removed, e.g. 0.2
+	Jitter *float64 `json:"jitter"`
+}
+
+// Controls how long the CPI polls photon tasks. Zero values use the photon SDK defaults.
+type TasksConfig struct {
+	PollTimeout Duration `json:"poll_timeout"`
+	PollDelay   Duration `json:"poll_delay"`
+	RetryCount  int      `json:"retry_count"`
+	// Poll timeouts for specific CPI actions, e.g. {"create_stemcell": "2h"}
+	ActionTimeouts map[string]Duration `json:"action_timeouts"`
+}
+
+// time.Duration that is read from JSON strings such as "5m" or "1h30m"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) (err error) {
+	var s string
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return
+	}
+	*d = Duration(duration)
+	return
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Controls how BOSH VM metadata is stored on Photon VMs
+type MetadataConfig struct {
+	// Prepended to every metadata key sent by BOSH, e.g. "bosh-"
+	KeyPrefix string `json:"key_prefix"`
+	// Metadata keys (before prefixing) that are also copied into VM tags
+	TagKeys []string `json:"tag_keys"`
 }
 
 type AgentConfig struct {
 	Mbus      string        `json:"mbus"`
 	NTP       []string      `json:"ntp"`
 	Blobstore BlobstoreSpec `json:"blobstore"`
+	// Layout of the agent settings ISO, SettingsFormatEnv when empty
+	SettingsFormat string `json:"settings_format"`
+	// How the agent gets its settings, SettingsDeliveryISO when empty
+	SettingsDelivery string `json:"settings_delivery"`
 }
 
+const (
+	// Settings ISO attached to the VM, rebuilt on every change
+	SettingsDeliveryISO = "iso"
+	// Settings stored in VM metadata and served by the CPI's registry, the ISO only
+	// carries the registry endpoint
+	SettingsDeliveryRegistry = "registry"
+)
+
+const (
+	// Single "env" file, read by the agent's CDROM settings source
+	SettingsFormatEnv = "env"
+	// OpenStack config-drive labelled config-2, read by the agent's ConfigDrive settings source
+	SettingsFormatConfigDrive = "config-drive"
+	// Both layouts on the same ISO, for moving between stemcells
+	SettingsFormatBoth = "both"
+)
+
 type PhotonConfig struct {
 	Target            string `json:"target"`
 	ProjectID         string `json:"project"`
 	TenantID          string `json:"tenant"`
 	IgnoreCertificate bool   `json:"ignore_cert"`
 	Token             string `json:"token"`
+	User              string `json:"user"`
+	Password          string `json:"password"`
+	RefreshToken      string `json:"refresh_token"`
+	// PEM encoded CA certificates used to verify photon, inline or from a file
+	CACert     string `json:"ca_cert"`
+	CACertFile string `json:"ca_cert_file"`
+	// PEM encoded client certificate and key for mutual TLS
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
 }
 
 type ActionFn func(*Context, []interface{}) (interface{}, error)
@@ -51,11 +162,62 @@ const (
 	CpiError            BoshErrorType = "Bosh::Clouds::CpiError"
 	NotImplementedError BoshErrorType = "Bosh::Clouds::NotImplemented"
 	NotSupportedError   BoshErrorType = "Bosh::Clouds::NotSupported"
+	VMCreationFailed    BoshErrorType = "Bosh::Clouds::VMCreationFailed"
 )
 
 type Request struct {
-	Method    string        `json:"method"`
-	Arguments []interface{} `json:"arguments"`
+	Method     string         `json:"method"`
+	Arguments  []interface{}  `json:"arguments"`
+	Context    RequestContext `json:"context"`
+	ApiVersion int            `json:"api_version"`
+}
+
+type RequestContext struct {
+	DirectorUUID string    `json:"director_uuid"`
+	RequestID    string    `json:"request_id"`
+	VM           VMContext `json:"vm"`
+	// CPI properties from the director's cpi_config, in the same layout as Config
+	Properties map[string]interface{} `json:"-"`
+}
+
+// Context keys that are set by the director itself rather than by cpi_config
+var requestContextKeys = []string{"director_uuid", "request_id", "vm"}
+
+func (c *RequestContext) UnmarshalJSON(data []byte) (err error) {
+	// Separate type without this method so decoding doesn't recurse
+	type requestContext RequestContext
+	ctx := requestContext{}
+	err = json.Unmarshal(data, &ctx)
+	if err != nil {
+		return
+	}
+	properties := map[string]interface{}{}
+	err = json.Unmarshal(data, &properties)
+	if err != nil {
+		return
+	}
+	for _, key := range requestContextKeys {
+		delete(properties, key)
+	}
+	ctx.Properties = properties
+	*c = RequestContext(ctx)
+	return
+}
+
+type VMContext struct {
+	Stemcell StemcellContext `json:"stemcell"`
+}
+
+type StemcellContext struct {
+	ApiVersion int `json:"api_version"`
+}
+
+// Result of the info action, used by the director to discover CPI capabilities
+type Info struct {
+	ApiVersion      int      `json:"api_version"`
+	StemcellFormats []string `json:"stemcell_formats"`
+	Version         string   `json:"version"`
+	NotImplemented  []string `json:"not_implemented"`
 }
 
 type Response struct {
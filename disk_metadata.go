@@ -0,0 +1,37 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"github.com/vmware/bosh-photon-cpi/cpi"
+)
+
+func SetDiskMetadata(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
+	if len(args) < 2 {
+		return nil, errors.New("Expected at least 2 arguments")
+	}
+	diskCID, ok := args[0].(string)
+	if !ok {
+		return nil, errors.New("Unexpected argument where disk_cid should be")
+	}
+	boshMetadata, ok := args[1].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Unexpected argument where metadata should be")
+	}
+
+	ctx.Logger.Infof("SetDiskMetadata with disk_cid: '%s', metadata: '%v'", diskCID, boshMetadata)
+
+	// Photon only accepts disk tags in DiskCreateSpec and has no API to tag or otherwise
+	// label an existing disk, so disk metadata can't be stored. The director ignores
+	// NotImplemented for set_disk_metadata.
+	return nil, cpi.NewBoshError(cpi.NotImplementedError, false,
+		"set_disk_metadata is not supported, photon can't update tags of existing disk %s", diskCID)
+}
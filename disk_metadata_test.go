@@ -0,0 +1,79 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	"github.com/vmware/bosh-photon-cpi/logger"
+	. "github.com/vmware/bosh-photon-cpi/mocks"
+	ec "github.com/vmware/photon-controller-go-sdk/photon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Disk metadata", func() {
+	var (
+		server *httptest.Server
+		ctx    *cpi.Context
+	)
+
+	BeforeEach(func() {
+		server = NewMockServer()
+		Activate(true)
+		httpClient := &http.Client{Transport: DefaultMockTransport}
+		ctx = &cpi.Context{
+			Client: ec.NewTestClient(server.URL, "", nil, httpClient),
+			Config: &cpi.Config{
+				Photon: &cpi.PhotonConfig{
+					Target:    server.URL,
+					ProjectID: "fake-project-id",
+				},
+			},
+			Logger: logger.New(),
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("returns NotImplemented without touching the disk", func() {
+		// No responders, so any photon request would fail
+		actions := map[string]cpi.ActionFn{
+			"set_disk_metadata": SetDiskMetadata,
+		}
+		args := []interface{}{
+			"fake-disk-id",
+			map[string]interface{}{"deployment": "fake-deployment", "instance_id": "fake-instance"},
+		}
+		res, err := GetResponse(dispatch(ctx, actions, "set_disk_metadata", args))
+
+		Expect(res.Result).Should(BeNil())
+		Expect(res.Error).ShouldNot(BeNil())
+		Expect(res.Error.Type).Should(Equal(cpi.NotImplementedError))
+		Expect(res.Error.Message).Should(ContainSubstring("set_disk_metadata is not supported"))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(res.Log).ShouldNot(BeEmpty())
+	})
+	It("should return an error when given an invalid argument", func() {
+		actions := map[string]cpi.ActionFn{
+			"set_disk_metadata": SetDiskMetadata,
+		}
+		args := []interface{}{"fake-disk-id", "not-a-map"}
+		res, err := GetResponse(dispatch(ctx, actions, "set_disk_metadata", args))
+
+		Expect(res.Result).Should(BeNil())
+		Expect(res.Error).ShouldNot(BeNil())
+		Expect(res.Error.Type).Should(Equal(cpi.CpiError))
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+})
@@ -14,7 +14,6 @@ import (
 	"github.com/vmware/bosh-photon-cpi/cpi"
 	ec "github.com/vmware/photon-controller-go-sdk/photon"
 	"math"
-	"net/http"
 )
 
 func CreateDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
@@ -37,6 +36,17 @@ func CreateDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err e
 	if !ok {
 		return nil, errors.New("Property 'disk_flavor' on cloud_properties is not a string")
 	}
+	vmAffinity := true
+	if value, ok := cloudProps["vm_affinity"]; ok {
+		vmAffinity, ok = value.(bool)
+		if !ok {
+			return nil, errors.New("Property 'vm_affinity' on cloud_properties is not a boolean")
+		}
+	}
+	zone, ok := cloudProps["availability_zone"].(string)
+	if _, present := cloudProps["availability_zone"]; present && !ok {
+		return nil, errors.New("Property 'availability_zone' on cloud_properties is not a string")
+	}
 	vmCID, ok := args[2].(string)
 	if !ok {
 		return nil, errors.New("Unexpected argument where vm_cid should be")
@@ -52,6 +62,21 @@ func CreateDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err e
 		CapacityGB: size,
 		Name:       "disk-for-vm-" + vmCID,
 	}
+	zoneVMCID := ""
+	// Keep the disk on a datastore the VM's host can reach, so attach_disk doesn't fail later.
+	// That already keeps it in the VM's zone, the zone only needs looking up without it.
+	if vmAffinity && vmCID != "" {
+		diskSpec.Affinities = []ec.LocalitySpec{ec.LocalitySpec{Kind: "vm", ID: vmCID}}
+	} else {
+		zoneVMCID = vmCID
+	}
+	zoneID, err := diskAvailabilityZone(ctx, zone, zoneVMCID)
+	if err != nil {
+		return
+	}
+	if zoneID != "" {
+		diskSpec.Affinities = append(diskSpec.Affinities, availabilityZoneAffinity(zoneID))
+	}
 
 	ctx.Logger.Infof("Creating disk with spec: %#v", diskSpec)
 	task, err := ctx.Client.Projects.CreateDisk(ctx.Config.Photon.ProjectID, diskSpec)
@@ -59,13 +84,29 @@ func CreateDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err e
 		return
 	}
 	ctx.Logger.Infof("Waiting on task: %#v", task)
-	task, err = ctx.Client.Tasks.Wait(task.ID)
+	task, err = waitForTask(ctx, task.ID)
 	if err != nil {
 		return
 	}
 	return task.Entity.ID, nil
 }
 
+// Disks go to the availability zone in their cloud_properties, or else to the zone of the VM
+// they are created for without affinity to
+func diskAvailabilityZone(ctx *cpi.Context, zone string, vmCID string) (zoneID string, err error) {
+	if zone != "" {
+		return resolveAvailabilityZone(ctx, zone)
+	}
+	if vmCID == "" {
+		return "", nil
+	}
+	vm, err := ctx.Client.VMs.Get(vmCID)
+	if err != nil {
+		return
+	}
+	return vmAvailabilityZone(vm), nil
+}
+
 func DeleteDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
 	if len(args) < 1 {
 		return nil, errors.New("Expected at least 1 argument")
@@ -79,12 +120,16 @@ func DeleteDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err e
 
 	ctx.Logger.Info("Deleting disk")
 	task, err := ctx.Client.Disks.Delete(diskCID)
+	if isNotFoundError(err) {
+		ctx.Logger.Infof("Disk '%s' not found, nothing to delete", diskCID)
+		return nil, nil
+	}
 	if err != nil {
 		return
 	}
 
 	ctx.Logger.Infof("Waiting on task: %#v", task)
-	task, err = ctx.Client.Tasks.Wait(task.ID)
+	task, err = waitForTask(ctx, task.ID)
 	if err != nil {
 		return
 	}
@@ -103,11 +148,10 @@ func HasDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err erro
 	ctx.Logger.Infof("HasDisk with disk_cid: '%s'", diskCID)
 
 	_, err = ctx.Client.Disks.Get(diskCID)
+	if isNotFoundError(err) {
+		return false, nil
+	}
 	if err != nil {
-		apiErr, ok := err.(ec.ApiError)
-		if ok && apiErr.HttpStatusCode == http.StatusNotFound {
-			return false, nil
-		}
 		return nil, err
 	}
 	return true, nil
@@ -119,22 +163,22 @@ func GetDisks(ctx *cpi.Context, args []interface{}) (result interface{}, err err
 	}
 	vmCID, ok := args[0].(string)
 	if !ok {
-		return nil, errors.New("Unexpected argument where vim_cid should be")
+		return nil, errors.New("Unexpected argument where vm_cid should be")
 	}
 
 	ctx.Logger.Infof("GetDisks with vm_cid: '%s'", vmCID)
 
-	disks, err := ctx.Client.Projects.GetDisks(ctx.Config.Photon.ProjectID, nil)
+	// Persistent disks attached to the VM are listed on the VM itself, so there's
+	// no need to scan every disk in the project.
+	vm, err := ctx.Client.VMs.Get(vmCID)
 	if err != nil {
 		return
 	}
 
 	res := []string{}
-	for _, disk := range disks.Items {
-		for _, vm := range disk.VMs {
-			if vm == vmCID {
-				res = append(res, disk.ID)
-			}
+	for _, disk := range vm.AttachedDisks {
+		if disk.Kind == "persistent-disk" {
+			res = append(res, disk.ID)
 		}
 	}
 	return res, nil
@@ -163,7 +207,7 @@ func AttachDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err e
 	}
 
 	ctx.Logger.Infof("Waiting on task: %#v", task)
-	task, err = ctx.Client.Tasks.Wait(task.ID)
+	task, err = waitForTask(ctx, task.ID)
 	if err != nil {
 		return
 	}
@@ -187,16 +231,26 @@ func AttachDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err e
 	}
 	// Agent expects a mapping of disk_cid to the ID that gets used by the agent
 	// to resolve the path to the device. In our case, it is the same ID as disk_cid.
-	diskMap[diskCID] = map[string]interface{}{
+	diskHint := map[string]interface{}{
 		"id":   diskCID,
 		"path": "",
 	}
+	diskMap[diskCID] = diskHint
 
-	err = updateAgentEnv(ctx, vmCID, env)
+	if isAgentEnvDiskManagedByDirector(ctx) {
+		// Keep the stored env current, but the director hands the disk hint to the agent
+		ctx.Logger.Info("Updating metadata for VM")
+		err = putAgentEnvMetadata(ctx, vmCID, env)
+	} else {
+		err = updateAgentEnv(ctx, vmCID, env)
+	}
 	if err != nil {
 		return
 	}
 
+	if ctx.ApiVersion >= 2 {
+		return diskHint, nil
+	}
 	return nil, nil
 }
 
@@ -223,7 +277,7 @@ func DetachDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err e
 	}
 
 	ctx.Logger.Infof("Waiting on task: %#v", task)
-	task, err = ctx.Client.Tasks.Wait(task.ID)
+	task, err = waitForTask(ctx, task.ID)
 	if err != nil {
 		return
 	}
@@ -239,7 +293,12 @@ func DetachDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err e
 		delete(diskMap, diskCID)
 	}
 
-	err = updateAgentEnv(ctx, vmCID, env)
+	if isAgentEnvDiskManagedByDirector(ctx) {
+		ctx.Logger.Info("Updating metadata for VM")
+		err = putAgentEnvMetadata(ctx, vmCID, env)
+	} else {
+		err = updateAgentEnv(ctx, vmCID, env)
+	}
 	if err != nil {
 		return
 	}
@@ -247,6 +306,44 @@ func DetachDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err e
 	return nil, nil
 }
 
+func ResizeDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
+	if len(args) < 2 {
+		return nil, errors.New("Expected at least 2 arguments")
+	}
+	diskCID, ok := args[0].(string)
+	if !ok {
+		return nil, errors.New("Unexpected argument where disk_cid should be")
+	}
+	newSizeMB, ok := args[1].(float64)
+	if !ok {
+		return nil, errors.New("Unexpected argument where new_size should be")
+	}
+	newSize := toGB(newSizeMB)
+
+	ctx.Logger.Infof(
+		"ResizeDisk with disk_cid: '%s', new_size: '%v' (rounded to '%v' GiB)", diskCID, newSizeMB, newSize)
+
+	ctx.Logger.Info("Getting disk")
+	disk, err := ctx.Client.Disks.Get(diskCID)
+	if err != nil {
+		return
+	}
+
+	if newSize < disk.CapacityGB {
+		return nil, cpi.NewBoshError(cpi.CpiError, false,
+			"Cannot shrink disk %s from %d GiB to %d GiB", diskCID, disk.CapacityGB, newSize)
+	}
+	if newSize == disk.CapacityGB {
+		ctx.Logger.Infof("Disk %s is already %d GiB, nothing to resize", diskCID, newSize)
+		return nil, nil
+	}
+
+	// Photon has no API to grow a persistent disk. NotSupported tells the director to
+	// fall back to creating a new disk and migrating the data.
+	return nil, cpi.NewBoshError(cpi.NotSupportedError, false,
+		"Photon does not support growing disk %s from %d GiB to %d GiB", diskCID, disk.CapacityGB, newSize)
+}
+
 func toGB(mb float64) int {
 	return int(math.Ceil(mb / 1000.0))
 }
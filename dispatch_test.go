@@ -10,6 +10,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/vmware/bosh-photon-cpi/cpi"
@@ -17,8 +18,12 @@ import (
 	. "github.com/vmware/bosh-photon-cpi/mocks"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	ec "github.com/vmware/photon-controller-go-sdk/photon"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"time"
 )
 
 var _ = Describe("Dispatch", func() {
@@ -101,11 +106,182 @@ var _ = Describe("Dispatch", func() {
 		jsonConfig := `{"photon":{"Target":"http://none:123"}}`
 		configFile.WriteString(jsonConfig)
 
-		context, err := loadConfig(configPath)
+		context, err := loadConfig(configPath, nil)
 		expectedURL := fmt.Sprintf("http://%s:%d", "none", 123)
 		Expect(context.Client.Endpoint).Should(Equal(expectedURL))
 		Expect(err).Should(BeNil())
 	})
+	It("overlays JSON config with request context properties", func() {
+		configFile, err := ioutil.TempFile("", "bosh-photon-cpi-config")
+		if err != nil {
+			panic(err)
+		}
+		configPath = configFile.Name()
+		jsonConfig := `{"photon":{"target":"http://none:123","tenant":"file-tenant","project":"file-project","token":"file-token"},` +
+			`"agent":{"mbus":"fake-mbus"}}`
+		configFile.WriteString(jsonConfig)
+
+		reqContext := &cpi.RequestContext{}
+		err = json.Unmarshal([]byte(`{
+			"director_uuid": "fake-director-uuid",
+			"request_id": "fake-request-id",
+			"photon": {"target": "http://other:456", "project": "context-project"}
+		}`), reqContext)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(reqContext.Properties).ShouldNot(HaveKey("director_uuid"))
+
+		context, err := loadConfig(configPath, reqContext.Properties)
+		Expect(err).Should(BeNil())
+		Expect(context.Client.Endpoint).Should(Equal("http://other:456"))
+		Expect(context.Config.Photon.ProjectID).Should(Equal("context-project"))
+		Expect(context.Config.Photon.TenantID).Should(Equal("file-tenant"))
+		Expect(context.Config.Photon.Token).Should(Equal("file-token"))
+		Expect(context.Config.Agent.Mbus).Should(Equal("fake-mbus"))
+	})
+	It("loads task timeouts from JSON config", func() {
+		configFile, err := ioutil.TempFile("", "bosh-photon-cpi-config")
+		if err != nil {
+			panic(err)
+		}
+		configPath = configFile.Name()
+		configFile.WriteString(`{"photon":{"target":"http://none:123"},` +
+			`"tasks":{"poll_timeout":"45m","poll_delay":"1s","retry_count":5,` +
+			`"action_timeouts":{"create_stemcell":"2h","detach_disk":"5m"}}}`)
+
+		context, err := loadConfig(configPath, nil)
+		Expect(err).Should(BeNil())
+		Expect(context.Config.Tasks.PollTimeout).Should(Equal(cpi.Duration(45 * time.Minute)))
+		Expect(context.Config.Tasks.PollDelay).Should(Equal(cpi.Duration(time.Second)))
+		Expect(context.Config.Tasks.RetryCount).Should(Equal(5))
+		Expect(context.Config.Tasks.ActionTimeouts).Should(Equal(map[string]cpi.Duration{
+			"create_stemcell": cpi.Duration(2 * time.Hour),
+			"detach_disk":     cpi.Duration(5 * time.Minute),
+		}))
+	})
+	It("returns an error for invalid task timeouts in JSON config", func() {
+		configFile, err := ioutil.TempFile("", "bosh-photon-cpi-config")
+		if err != nil {
+			panic(err)
+		}
+		configPath = configFile.Name()
+		configFile.WriteString(`{"photon":{"target":"http://none:123"},"tasks":{"poll_timeout":"soon"}}`)
+
+		_, err = loadConfig(configPath, nil)
+		Expect(err).Should(HaveOccurred())
+	})
+	It("returns an error for an unsupported settings delivery in JSON config", func() {
+		configFile, err := ioutil.TempFile("", "bosh-photon-cpi-config")
+		if err != nil {
+			panic(err)
+		}
+		configPath = configFile.Name()
+		configFile.WriteString(`{"photon":{"target":"http://none:123"},"agent":{"settings_delivery":"metadata"}}`)
+
+		_, err = loadConfig(configPath, nil)
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).Should(ContainSubstring("Unknown agent settings_delivery 'metadata'"))
+	})
+	It("returns an error when request context properties do not match the config", func() {
+		configFile, err := ioutil.TempFile("", "bosh-photon-cpi-config")
+		if err != nil {
+			panic(err)
+		}
+		configPath = configFile.Name()
+		configFile.WriteString(`{"photon":{"target":"http://none:123"}}`)
+
+		properties := map[string]interface{}{"photon": "not-an-object"}
+		_, err = loadConfig(configPath, properties)
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("reads the CPI API v2 request envelope", func() {
+		reqJson := `{
+			"method": "create_vm",
+			"arguments": ["fake-agent-id"],
+			"api_version": 2,
+			"context": {
+				"director_uuid": "fake-director-uuid",
+				"request_id": "fake-request-id",
+				"vm": {"stemcell": {"api_version": 2}}
+			}
+		}`
+		req := &cpi.Request{}
+		err := json.Unmarshal([]byte(reqJson), req)
+
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(req.ApiVersion).Should(Equal(2))
+		Expect(req.Context.DirectorUUID).Should(Equal("fake-director-uuid"))
+		Expect(req.Context.RequestID).Should(Equal("fake-request-id"))
+		Expect(req.Context.VM.Stemcell.ApiVersion).Should(Equal(2))
+	})
+	It("negotiates the CPI API version", func() {
+		Expect(negotiateApiVersion(0)).Should(Equal(1))
+		Expect(negotiateApiVersion(1)).Should(Equal(1))
+		Expect(negotiateApiVersion(2)).Should(Equal(2))
+		Expect(negotiateApiVersion(apiVersion + 1)).Should(Equal(apiVersion))
+	})
+
+	Describe("CPI action table", func() {
+		var (
+			server *httptest.Server
+		)
+
+		BeforeEach(func() {
+			server = NewMockServer()
+			Activate(true)
+			httpClient := &http.Client{Transport: DefaultMockTransport}
+			ctx.Client = ec.NewTestClient(server.URL, "", nil, httpClient)
+			ctx.Config = &cpi.Config{
+				Photon: &cpi.PhotonConfig{
+					Target:    server.URL,
+					ProjectID: "fake-project-id",
+				},
+			}
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("registers get_disks", func() {
+			Expect(actions).Should(HaveKey("get_disks"))
+		})
+		It("dispatches get_disks to the persistent disks of a VM", func() {
+			vm := &ec.VM{
+				ID: "fake-vm-id",
+				AttachedDisks: []ec.AttachedDisk{
+					ec.AttachedDisk{ID: "boot-disk", Kind: "ephemeral-disk", BootDisk: true},
+					ec.AttachedDisk{ID: "fake-disk-id", Kind: "persistent-disk"},
+				},
+			}
+
+			RegisterResponder(
+				"GET",
+				server.URL+"/vms/"+vm.ID,
+				CreateResponder(200, ToJson(vm)))
+
+			args := []interface{}{"fake-vm-id"}
+			res, err := GetResponse(dispatch(ctx, actions, "get_disks", args))
+
+			Expect(res.Result).Should(ConsistOf("fake-disk-id"))
+			Expect(res.Error).Should(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		It("returns a CloudError from get_disks when VM is not found", func() {
+			RegisterResponder(
+				"GET",
+				server.URL+"/vms/fake-vm-id",
+				CreateResponder(404, ToJson(ec.ApiError{Code: "VmNotFound"})))
+
+			args := []interface{}{"fake-vm-id"}
+			res, err := GetResponse(dispatch(ctx, actions, "get_disks", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.CloudError))
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+	})
 })
 
 func createVM(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
@@ -0,0 +1,37 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"github.com/vmware/bosh-photon-cpi/cpi"
+)
+
+// Highest CPI API version understood by this CPI
+const apiVersion = 2
+
+// Stemcell formats accepted by create_stemcell
+var stemcellFormats = []string{"photon-ova", "vsphere-ova"}
+
+// Actions that are registered but always return NotImplemented, because photon has no API
+// to back them
+var notImplementedActions = []string{"set_disk_metadata", "snapshot_disk", "delete_snapshot"}
+
+// Build version of the CPI, set at build time with -ldflags "-X main.version=<version>"
+var version = "dev"
+
+func Info(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
+	ctx.Logger.Info("Info")
+	return &cpi.Info{
+		ApiVersion:      apiVersion,
+		StemcellFormats: stemcellFormats,
+		Version:         version,
+		NotImplemented:  notImplementedActions,
+	}, nil
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	"github.com/vmware/bosh-photon-cpi/logger"
+	. "github.com/vmware/bosh-photon-cpi/mocks"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Info", func() {
+	var (
+		ctx *cpi.Context
+	)
+
+	BeforeEach(func() {
+		ctx = &cpi.Context{
+			Logger: logger.New(),
+		}
+	})
+
+	It("returns the API version, stemcell formats, build version and unsupported actions", func() {
+		res, err := GetResponse(dispatch(ctx, actions, "info", []interface{}{}))
+
+		Expect(res.Error).Should(BeNil())
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(res.Result).Should(Equal(map[string]interface{}{
+			"api_version":      float64(apiVersion),
+			"stemcell_formats": []interface{}{"photon-ova", "vsphere-ova"},
+			"version":          "dev",
+			"not_implemented":  []interface{}{"set_disk_metadata", "snapshot_disk", "delete_snapshot"},
+		}))
+		Expect(res.Log).ShouldNot(BeEmpty())
+	})
+})
@@ -0,0 +1,87 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+// Package iso9660 writes and reads small ISO 9660 images such as the agent settings
+// and config-drive CD-ROMs attached to VMs.
+//
+// Images carry three views of the same files:
+//   - the primary ISO 9660 tree with 8.3 upper case names
+//   - Rock Ridge (RRIP 1.10 PX and NM entries) on the primary tree with the original names
+//   - a Joliet tree with the original names in UCS-2
+package iso9660
+
+import (
+	"encoding/binary"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize = 2048
+
+	// Volume descriptors start after the 16 sector system area
+	firstDescriptorSector = 16
+
+	descriptorPrimary       = 1
+	descriptorSupplementary = 2
+	descriptorTerminator    = 255
+
+	flagDirectory = 0x02
+
+	// Longest name Joliet allows, also applied to Rock Ridge names to keep
+	// directory records within 255 bytes
+	maxNameLength = 64
+)
+
+var (
+	standardID = []byte("CD001")
+	// Escape sequence for UCS-2 level 3, marks a supplementary descriptor as Joliet
+	jolietEscape = []byte("%/E")
+)
+
+// Naming extension used to resolve file names when reading an image
+type Extension int
+
+const (
+	// Plain ISO 9660 names, matched case insensitively
+	Primary Extension = iota
+	RockRidge
+	Joliet
+)
+
+// Writes v in little endian followed by big endian, as used throughout ISO 9660
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b[0:4], v)
+	binary.BigEndian.PutUint32(b[4:8], v)
+}
+
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b[0:2], v)
+	binary.BigEndian.PutUint16(b[2:4], v)
+}
+
+func encodeUCS2(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.BigEndian.PutUint16(b[2*i:], u)
+	}
+	return b
+}
+
+func decodeUCS2(b []byte) string {
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+func sectors(size int) int {
+	return (size + sectorSize - 1) / sectorSize
+}
@@ -7,25 +7,15 @@
 // license terms. Your use of these subcomponents is subject to the terms and conditions
 // of the subcomponent's license, as noted in the LICENSE file.
 
-package cmd
+package iso9660
 
 import (
-	"os/exec"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
 )
 
-type Runner interface {
-	Run(name string, args ...string) ([]byte, error)
-}
-
-type defaultRunner struct {
-}
-
-func NewRunner() Runner {
-	return &defaultRunner{}
-}
-
-func (_ defaultRunner) Run(name string, args ...string) (out []byte, err error) {
-	cmd := exec.Command(name, args...)
-	out, err = cmd.CombinedOutput()
-	return
+func TestISO9660(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "ISO 9660 Suite")
 }
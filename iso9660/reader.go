@@ -0,0 +1,231 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+type entry struct {
+	name   string
+	isDir  bool
+	extent uint32
+	size   uint32
+}
+
+// Reads files from an ISO 9660 image, resolving names with one naming extension
+type Reader struct {
+	r         io.ReaderAt
+	extension Extension
+	volumeID  string
+	root      entry
+}
+
+func NewReader(r io.ReaderAt, extension Extension) (reader *Reader, err error) {
+	reader = &Reader{r: r, extension: extension}
+	found := false
+	for sector := firstDescriptorSector; ; sector++ {
+		d := make([]byte, sectorSize)
+		_, err = r.ReadAt(d, int64(sector)*sectorSize)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read ISO volume descriptor: %v", err)
+		}
+		if !bytes.Equal(d[1:6], standardID) {
+			return nil, errors.New("Not an ISO 9660 image")
+		}
+		if d[0] == descriptorTerminator {
+			break
+		}
+		joliet := d[0] == descriptorSupplementary && bytes.Equal(d[88:91], jolietEscape)
+		primary := d[0] == descriptorPrimary
+		if (extension == Joliet && joliet) || (extension != Joliet && primary) {
+			reader.root = parseRecord(d[156:190], Primary)
+			reader.volumeID = strings.TrimRight(string(d[40:72]), " ")
+			if joliet {
+				reader.volumeID = strings.TrimRight(decodeUCS2(d[40:72]), " ")
+			}
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("ISO image has no volume descriptor for extension %d", extension)
+	}
+	if extension == RockRidge {
+		self, err := reader.readRecords(reader.root, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(self) == 0 || !bytes.HasPrefix(systemUse(self[0]), []byte{'S', 'P', 7, 1, 0xBE, 0xEF}) {
+			return nil, errors.New("ISO image has no Rock Ridge extension")
+		}
+	}
+	return reader, nil
+}
+
+func (r *Reader) VolumeID() string {
+	return r.volumeID
+}
+
+// Names of the files and directories in a directory, "" or "/" for the root
+func (r *Reader) ReadDir(name string) (names []string, err error) {
+	dir, err := r.lookup(name)
+	if err != nil {
+		return
+	}
+	if !dir.isDir {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := r.entries(dir)
+	if err != nil {
+		return
+	}
+	names = []string{}
+	for _, e := range entries {
+		names = append(names, e.name)
+	}
+	return
+}
+
+func (r *Reader) ReadFile(name string) (data []byte, err error) {
+	file, err := r.lookup(name)
+	if err != nil {
+		return
+	}
+	if file.isDir {
+		return nil, &os.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	data = make([]byte, file.size)
+	_, err = r.r.ReadAt(data, int64(file.extent)*sectorSize)
+	return
+}
+
+func (r *Reader) lookup(name string) (current entry, err error) {
+	current = r.root
+	for _, part := range strings.Split(name, "/") {
+		if part == "" {
+			continue
+		}
+		if !current.isDir {
+			return entry{}, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		entries, err := r.entries(current)
+		if err != nil {
+			return entry{}, err
+		}
+		found := false
+		for _, e := range entries {
+			if e.name == part || (r.extension == Primary && strings.EqualFold(e.name, part)) {
+				current, found = e, true
+				break
+			}
+		}
+		if !found {
+			return entry{}, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+	}
+	return current, nil
+}
+
+// Directory entries without the "." and ".." records
+func (r *Reader) entries(dir entry) (entries []entry, err error) {
+	records, err := r.readRecords(dir, false)
+	if err != nil {
+		return
+	}
+	for _, record := range records {
+		identifier := record[33 : 33+record[32]]
+		if len(identifier) == 1 && identifier[0] <= 1 {
+			continue
+		}
+		entries = append(entries, parseRecord(record, r.extension))
+	}
+	return
+}
+
+func (r *Reader) readRecords(dir entry, firstOnly bool) (records [][]byte, err error) {
+	extent := make([]byte, dir.size)
+	_, err = r.r.ReadAt(extent, int64(dir.extent)*sectorSize)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read ISO directory: %v", err)
+	}
+	for pos := 0; pos < len(extent); {
+		length := int(extent[pos])
+		// Records don't cross sectors, the rest of a sector is zero filled
+		if length == 0 {
+			pos = (pos/sectorSize + 1) * sectorSize
+			continue
+		}
+		if length < 34 || pos+length > len(extent) || 33+int(extent[pos+32]) > length {
+			return nil, errors.New("Invalid ISO directory record")
+		}
+		records = append(records, extent[pos:pos+length])
+		if firstOnly {
+			break
+		}
+		pos += length
+	}
+	return
+}
+
+func parseRecord(record []byte, extension Extension) entry {
+	e := entry{
+		isDir:  record[25]&flagDirectory != 0,
+		extent: binary.LittleEndian.Uint32(record[2:]),
+		size:   binary.LittleEndian.Uint32(record[10:]),
+	}
+	identifier := record[33 : 33+record[32]]
+	switch extension {
+	case Joliet:
+		e.name = decodeUCS2(identifier)
+	case RockRidge:
+		e.name = rockRidgeName(systemUse(record))
+	}
+	if e.name == "" {
+		e.name = string(identifier)
+	}
+	// Drop file versions, which Rock Ridge names never have
+	if !e.isDir && (extension != RockRidge || e.name == string(identifier)) {
+		e.name = strings.TrimSuffix(strings.TrimSuffix(e.name, ";1"), ".")
+	}
+	return e
+}
+
+func systemUse(record []byte) []byte {
+	start := 33 + int(record[32])
+	if record[32]%2 == 0 {
+		start++
+	}
+	if start > len(record) {
+		return nil
+	}
+	return record[start:]
+}
+
+// Joins the NM entries of a record's system use area
+func rockRidgeName(systemUse []byte) string {
+	name := ""
+	for len(systemUse) >= 4 {
+		length := int(systemUse[2])
+		if length < 4 || length > len(systemUse) {
+			break
+		}
+		if systemUse[0] == 'N' && systemUse[1] == 'M' && length >= 5 {
+			name += string(systemUse[5:length])
+		}
+		systemUse = systemUse[length:]
+	}
+	return name
+}
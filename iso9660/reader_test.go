@@ -0,0 +1,58 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package iso9660
+
+import (
+	"bytes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"os"
+)
+
+var _ = Describe("Reader", func() {
+	var buffer *bytes.Buffer
+
+	BeforeEach(func() {
+		buffer = &bytes.Buffer{}
+	})
+
+	It("reports missing files", func() {
+		writer := NewWriter()
+		Expect(writer.AddFile("env", []byte("{}"))).Should(Succeed())
+		_, err := writer.WriteTo(buffer)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		reader, err := NewReader(bytes.NewReader(buffer.Bytes()), Joliet)
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = reader.ReadFile("settings")
+		Expect(os.IsNotExist(err)).Should(BeTrue())
+	})
+
+	It("tells files and directories apart", func() {
+		writer := NewWriter()
+		Expect(writer.AddFile("openstack/latest/user_data", []byte("{}"))).Should(Succeed())
+		_, err := writer.WriteTo(buffer)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		reader, err := NewReader(bytes.NewReader(buffer.Bytes()), RockRidge)
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = reader.ReadFile("openstack/latest")
+		Expect(err).Should(HaveOccurred())
+		_, err = reader.ReadDir("openstack/latest/user_data")
+		Expect(err).Should(HaveOccurred())
+		_, err = reader.ReadFile("openstack/latest/user_data/env")
+		Expect(os.IsNotExist(err)).Should(BeTrue())
+	})
+
+	It("rejects data that isn't an ISO image", func() {
+		_, err := NewReader(bytes.NewReader(make([]byte, 20*2048)), Primary)
+		Expect(err).Should(HaveOccurred())
+	})
+})
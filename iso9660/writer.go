@@ -0,0 +1,424 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Index of the primary and Joliet directory trees in per tree node fields
+const (
+	primaryTree = 0
+	jolietTree  = 1
+)
+
+const (
+	modeDirectory = 040555
+	modeFile      = 0100444
+
+	rockRidgeID     = "RRIP_1991A"
+	rockRidgeDesc   = "THE ROCK RIDGE INTERCHANGE PROTOCOL PROVIDES SUPPORT FOR POSIX FILE SYSTEM SEMANTICS"
+	rockRidgeSource = "PLEASE CONTACT DISC PUBLISHER FOR SPECIFICATION SOURCE"
+)
+
+type node struct {
+	name     string
+	isDir    bool
+	data     []byte
+	parent   *node
+	children []*node
+
+	// Per tree identifiers, child order, path table numbers and directory extents.
+	// Files share their data extent between both trees.
+	identifier [2][]byte
+	sorted     [2][]*node
+	number     [2]int
+	extent     [2]uint32
+	size       [2]uint32
+}
+
+func (n *node) child(name string) *node {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (n *node) location(tree int) (extent uint32, size uint32) {
+	if n.isDir {
+		return n.extent[tree], n.size[tree]
+	}
+	return n.extent[primaryTree], uint32(len(n.data))
+}
+
+// Builds an ISO 9660 image in memory from files added with AddFile
+type Writer struct {
+	// Volume label, e.g. "config-2"
+	VolumeID string
+	// Recording time of the volume and all files
+	ModTime time.Time
+
+	root *node
+}
+
+func NewWriter() *Writer {
+	return &Writer{ModTime: time.Now(), root: &node{isDir: true}}
+}
+
+// Adds a file at a slash separated path, creating parent directories as needed
+func (w *Writer) AddFile(name string, data []byte) error {
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	dir := w.root
+	for i, part := range parts {
+		if part == "" || part == "." || part == ".." || len(part) > maxNameLength ||
+			strings.ContainsRune(part, 0) {
+			return fmt.Errorf("Invalid file name for ISO image: '%s'", name)
+		}
+		last := i == len(parts)-1
+		child := dir.child(part)
+		if child == nil {
+			child = &node{name: part, isDir: !last, parent: dir}
+			dir.children = append(dir.children, child)
+		} else if last || !child.isDir {
+			return fmt.Errorf("File '%s' conflicts with an existing file in ISO image", name)
+		}
+		if last {
+			child.data = data
+		}
+		dir = child
+	}
+	return nil
+}
+
+// Writes the image. Layout is the system area, the primary, Joliet and terminating volume
+// descriptors, path tables, directories of both trees and finally the file data.
+func (w *Writer) WriteTo(out io.Writer) (n int64, err error) {
+	w.prepare(w.root)
+	var dirs [2][]*node
+	for tree := range dirs {
+		dirs[tree] = w.pathTableOrder(tree)
+	}
+
+	sector := firstDescriptorSector + 3
+	var pathTableSize, pathTableL, pathTableM [2]uint32
+	for tree := range dirs {
+		pathTableSize[tree] = uint32(len(pathTable(dirs[tree], tree, binary.LittleEndian)))
+		pathTableL[tree] = uint32(sector)
+		sector += sectors(int(pathTableSize[tree]))
+		pathTableM[tree] = uint32(sector)
+		sector += sectors(int(pathTableSize[tree]))
+	}
+	// Directory sizes only depend on names, so they can be computed before extents are known
+	for tree := range dirs {
+		for _, dir := range dirs[tree] {
+			dir.size[tree] = uint32(len(w.directory(dir, tree)))
+			dir.extent[tree] = uint32(sector)
+			sector += sectors(int(dir.size[tree]))
+		}
+	}
+	firstFileSector := sector
+	files := w.files(w.root, nil)
+	for _, file := range files {
+		file.extent[primaryTree] = uint32(sector)
+		sector += sectors(len(file.data))
+	}
+	volumeSpace := uint32(sector)
+
+	meta := make([]byte, firstFileSector*sectorSize)
+	for tree := range dirs {
+		d := w.volumeDescriptor(tree, volumeSpace, pathTableSize[tree], pathTableL[tree], pathTableM[tree])
+		copy(meta[(firstDescriptorSector+tree)*sectorSize:], d)
+		copy(meta[pathTableL[tree]*sectorSize:], pathTable(dirs[tree], tree, binary.LittleEndian))
+		copy(meta[pathTableM[tree]*sectorSize:], pathTable(dirs[tree], tree, binary.BigEndian))
+		for _, dir := range dirs[tree] {
+			copy(meta[dir.extent[tree]*sectorSize:], w.directory(dir, tree))
+		}
+	}
+	terminator := meta[(firstDescriptorSector+2)*sectorSize:]
+	terminator[0] = descriptorTerminator
+	copy(terminator[1:6], standardID)
+	terminator[6] = 1
+
+	written, err := out.Write(meta)
+	n += int64(written)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		padding := sectors(len(file.data))*sectorSize - len(file.data)
+		for _, b := range [][]byte{file.data, make([]byte, padding)} {
+			written, err = out.Write(b)
+			n += int64(written)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Assigns identifiers and child order for both trees
+func (w *Writer) prepare(dir *node) {
+	used := map[string]bool{}
+	for _, c := range dir.children {
+		c.identifier[primaryTree] = []byte(isoIdentifier(c.name, c.isDir, used))
+		joliet := c.name
+		if !c.isDir {
+			joliet += ";1"
+		}
+		c.identifier[jolietTree] = encodeUCS2(joliet)
+		if c.isDir {
+			w.prepare(c)
+		}
+	}
+	for tree := range dir.sorted {
+		sorted := append([]*node{}, dir.children...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return bytes.Compare(sorted[i].identifier[tree], sorted[j].identifier[tree]) < 0
+		})
+		dir.sorted[tree] = sorted
+	}
+}
+
+// Maps a name to a unique 8.3 upper case identifier within its directory
+func isoIdentifier(name string, isDir bool, used map[string]bool) string {
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 && !isDir {
+		base, ext = name[:i], name[i+1:]
+	}
+	base, ext = dCharacters(base, 8), dCharacters(ext, 3)
+	format := func(base string) string {
+		if isDir {
+			return base
+		}
+		return base + "." + ext + ";1"
+	}
+	identifier := format(base)
+	for i := 1; used[identifier]; i++ {
+		suffix := strconv.Itoa(i)
+		if len(base)+len(suffix) > 8 {
+			base = base[:8-len(suffix)]
+		}
+		identifier = format(base + suffix)
+	}
+	used[identifier] = true
+	return identifier
+}
+
+func dCharacters(s string, max int) string {
+	b := []byte{}
+	for _, r := range strings.ToUpper(s) {
+		if len(b) == max {
+			break
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			b = append(b, byte(r))
+		} else {
+			b = append(b, '_')
+		}
+	}
+	return string(b)
+}
+
+// Directories in breadth first order, which is the order path tables require
+func (w *Writer) pathTableOrder(tree int) []*node {
+	dirs := []*node{w.root}
+	for i := 0; i < len(dirs); i++ {
+		dirs[i].number[tree] = i + 1
+		for _, c := range dirs[i].sorted[tree] {
+			if c.isDir {
+				dirs = append(dirs, c)
+			}
+		}
+	}
+	return dirs
+}
+
+func (w *Writer) files(dir *node, files []*node) []*node {
+	for _, c := range dir.sorted[primaryTree] {
+		if c.isDir {
+			files = w.files(c, files)
+		} else {
+			files = append(files, c)
+		}
+	}
+	return files
+}
+
+func pathTable(dirs []*node, tree int, order binary.ByteOrder) []byte {
+	table := []byte{}
+	for _, dir := range dirs {
+		identifier, parent := []byte{0}, 1
+		if dir.parent != nil {
+			identifier, parent = dir.identifier[tree], dir.parent.number[tree]
+		}
+		record := make([]byte, 8+len(identifier)+len(identifier)%2)
+		record[0] = byte(len(identifier))
+		order.PutUint32(record[2:], dir.extent[tree])
+		order.PutUint16(record[6:], uint16(parent))
+		copy(record[8:], identifier)
+		table = append(table, record...)
+	}
+	return table
+}
+
+// Encodes the extent of a directory. Records never cross sector boundaries.
+func (w *Writer) directory(dir *node, tree int) []byte {
+	extent := []byte{}
+	add := func(record []byte) {
+		if len(extent)%sectorSize+len(record) > sectorSize {
+			extent = append(extent, make([]byte, sectorSize-len(extent)%sectorSize)...)
+		}
+		extent = append(extent, record...)
+	}
+	parent := dir.parent
+	if parent == nil {
+		parent = dir
+	}
+	add(w.record(dir, tree, []byte{0}, w.systemUse(dir, tree, "", dir == w.root)))
+	add(w.record(parent, tree, []byte{1}, w.systemUse(parent, tree, "", false)))
+	for _, c := range dir.sorted[tree] {
+		add(w.record(c, tree, c.identifier[tree], w.systemUse(c, tree, c.name, false)))
+	}
+	return append(extent, make([]byte, sectors(len(extent))*sectorSize-len(extent))...)
+}
+
+func (w *Writer) record(n *node, tree int, identifier []byte, systemUse []byte) []byte {
+	length := 33 + len(identifier)
+	if len(identifier)%2 == 0 {
+		length++
+	}
+	systemUseStart := length
+	length += len(systemUse)
+	if length%2 == 1 {
+		length++
+	}
+
+	extent, size := n.location(tree)
+	record := make([]byte, length)
+	record[0] = byte(length)
+	putBoth32(record[2:], extent)
+	putBoth32(record[10:], size)
+	t := w.ModTime.UTC()
+	copy(record[18:25], []byte{byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()),
+		byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 0})
+	if n.isDir {
+		record[25] = flagDirectory
+	}
+	putBoth16(record[28:], 1)
+	record[32] = byte(len(identifier))
+	copy(record[33:], identifier)
+	copy(record[systemUseStart:], systemUse)
+	return record
+}
+
+// Rock Ridge entries for the primary tree. The root directory also announces the
+// extension with SP and ER entries.
+func (w *Writer) systemUse(n *node, tree int, name string, root bool) []byte {
+	if tree != primaryTree {
+		return nil
+	}
+	systemUse := []byte{}
+	if root {
+		systemUse = append(systemUse, 'S', 'P', 7, 1, 0xBE, 0xEF, 0)
+	}
+
+	mode, links := uint32(modeFile), uint32(1)
+	if n.isDir {
+		mode, links = modeDirectory, 2
+		for _, c := range n.children {
+			if c.isDir {
+				links++
+			}
+		}
+	}
+	px := make([]byte, 36)
+	copy(px, []byte{'P', 'X', 36, 1})
+	putBoth32(px[4:], mode)
+	putBoth32(px[12:], links)
+	systemUse = append(systemUse, px...)
+
+	if name != "" {
+		systemUse = append(systemUse, 'N', 'M', byte(5+len(name)), 1, 0)
+		systemUse = append(systemUse, name...)
+	}
+	if root {
+		er := []byte{'E', 'R', 0, 1, byte(len(rockRidgeID)), byte(len(rockRidgeDesc)), byte(len(rockRidgeSource)), 1}
+		er = append(er, rockRidgeID+rockRidgeDesc+rockRidgeSource...)
+		er[2] = byte(len(er))
+		systemUse = append(systemUse, er...)
+	}
+	return systemUse
+}
+
+func (w *Writer) volumeDescriptor(tree int, volumeSpace, pathTableSize, pathTableL, pathTableM uint32) []byte {
+	d := make([]byte, sectorSize)
+	d[0] = descriptorPrimary
+	if tree == jolietTree {
+		d[0] = descriptorSupplementary
+		copy(d[88:], jolietEscape)
+	}
+	copy(d[1:6], standardID)
+	d[6] = 1
+	putString(d[8:40], "", tree)
+	putString(d[40:72], w.VolumeID, tree)
+	putBoth32(d[80:], volumeSpace)
+	putBoth16(d[120:], 1)
+	putBoth16(d[124:], 1)
+	putBoth16(d[128:], sectorSize)
+	putBoth32(d[132:], pathTableSize)
+	binary.LittleEndian.PutUint32(d[140:], pathTableL)
+	binary.BigEndian.PutUint32(d[148:], pathTableM)
+	copy(d[156:190], w.record(w.root, tree, []byte{0}, nil))
+	putString(d[190:318], "", tree)
+	putString(d[318:446], "", tree)
+	putString(d[446:574], "", tree)
+	putString(d[574:702], "BOSH PHOTON CPI", tree)
+	putString(d[702:739], "", tree)
+	putString(d[739:776], "", tree)
+	putString(d[776:813], "", tree)
+	t := w.ModTime.UTC()
+	date := fmt.Sprintf("%04d%02d%02d%02d%02d%02d%02d", t.Year(), t.Month(), t.Day(),
+		t.Hour(), t.Minute(), t.Second(), t.Nanosecond()/10000000)
+	copy(d[813:], date)
+	copy(d[830:], date)
+	copy(d[847:], "0000000000000000")
+	copy(d[864:], "0000000000000000")
+	d[881] = 1
+	return d
+}
+
+// Fills a descriptor string field, padded with spaces. Joliet fields are UCS-2.
+func putString(field []byte, s string, tree int) {
+	if tree == jolietTree {
+		for i := 0; i+1 < len(field); i += 2 {
+			field[i], field[i+1] = 0, ' '
+		}
+		encoded := encodeUCS2(s)
+		if len(encoded) > len(field)&^1 {
+			encoded = encoded[:len(field)&^1]
+		}
+		copy(field, encoded)
+		return
+	}
+	for i := range field {
+		field[i] = ' '
+	}
+	copy(field, s)
+}
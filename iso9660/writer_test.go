@@ -0,0 +1,100 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package iso9660
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"strings"
+)
+
+var _ = Describe("Writer", func() {
+	var buffer *bytes.Buffer
+
+	BeforeEach(func() {
+		buffer = &bytes.Buffer{}
+	})
+
+	It("round trips nested files under all naming extensions", func() {
+		files := map[string]string{
+			"env":                                 `{"agent_id":"agent-id"}`,
+			"openstack/latest/meta_data.json":     "meta data",
+			"openstack/latest/user_data":          "user data",
+			"openstack/2012-08-10/meta_data.json": "",
+			"large":                               strings.Repeat("0123456789", 1000),
+		}
+		writer := NewWriter()
+		writer.VolumeID = "config-2"
+		for name, data := range files {
+			Expect(writer.AddFile(name, []byte(data))).Should(Succeed())
+		}
+		_, err := writer.WriteTo(buffer)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(buffer.Len() % 2048).Should(Equal(0))
+
+		for _, extension := range []Extension{RockRidge, Joliet} {
+			reader, err := NewReader(bytes.NewReader(buffer.Bytes()), extension)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(reader.VolumeID()).Should(Equal("config-2"))
+			for name, data := range files {
+				read, err := reader.ReadFile(name)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(string(read)).Should(Equal(data))
+			}
+			names, err := reader.ReadDir("openstack")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(names).Should(Equal([]string{"2012-08-10", "latest"}))
+		}
+
+		reader, err := NewReader(bytes.NewReader(buffer.Bytes()), Primary)
+		Expect(err).ShouldNot(HaveOccurred())
+		names, err := reader.ReadDir("/")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(names).Should(Equal([]string{"ENV", "LARGE", "OPENSTAC"}))
+	})
+
+	It("gives colliding names unique primary identifiers", func() {
+		writer := NewWriter()
+		for i := 0; i < 100; i++ {
+			name := fmt.Sprintf("settings-file-%03d.json", i)
+			Expect(writer.AddFile(name, []byte(name))).Should(Succeed())
+		}
+		_, err := writer.WriteTo(buffer)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		reader, err := NewReader(bytes.NewReader(buffer.Bytes()), Primary)
+		Expect(err).ShouldNot(HaveOccurred())
+		names, err := reader.ReadDir("")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(names).Should(HaveLen(100))
+		unique := map[string]bool{}
+		for _, name := range names {
+			unique[name] = true
+		}
+		Expect(unique).Should(HaveLen(100))
+
+		reader, err = NewReader(bytes.NewReader(buffer.Bytes()), RockRidge)
+		Expect(err).ShouldNot(HaveOccurred())
+		data, err := reader.ReadFile("settings-file-099.json")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(data)).Should(Equal("settings-file-099.json"))
+	})
+
+	It("rejects invalid and conflicting names", func() {
+		writer := NewWriter()
+		Expect(writer.AddFile("openstack/latest", []byte{})).Should(Succeed())
+		Expect(writer.AddFile("openstack/latest/meta_data.json", []byte{})).ShouldNot(Succeed())
+		Expect(writer.AddFile("openstack", []byte{})).ShouldNot(Succeed())
+		Expect(writer.AddFile("../env", []byte{})).ShouldNot(Succeed())
+		Expect(writer.AddFile(strings.Repeat("x", 65), []byte{})).ShouldNot(Succeed())
+	})
+})
@@ -12,6 +12,8 @@ package logger
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"sync"
 	"time"
 )
 
@@ -30,31 +32,51 @@ type Logger interface {
 	LogData() string
 }
 
+// Safe for use by multiple goroutines
 type bufferLogger struct {
+	out    io.Writer
 	buffer *bytes.Buffer
+	mutex  *sync.Mutex
 }
 
 func New() Logger {
-	return bufferLogger{&bytes.Buffer{}}
+	buffer := &bytes.Buffer{}
+	return bufferLogger{buffer, buffer, &sync.Mutex{}}
+}
+
+// Logger that writes straight to out and keeps no log data, for long running processes
+func NewStream(out io.Writer) Logger {
+	return bufferLogger{out, nil, &sync.Mutex{}}
+}
+
+func (l bufferLogger) write(s string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	io.WriteString(l.out, s)
 }
 
 func (l bufferLogger) Info(v ...interface{}) {
-	l.buffer.WriteString(timestamp() + infoStr + fmt.Sprint(v...) + "\n")
+	l.write(timestamp() + infoStr + fmt.Sprint(v...) + "\n")
 }
 
 func (l bufferLogger) Infof(format string, v ...interface{}) {
-	l.buffer.WriteString(timestamp() + infoStr + fmt.Sprintf(format, v...) + "\n")
+	l.write(timestamp() + infoStr + fmt.Sprintf(format, v...) + "\n")
 }
 
 func (l bufferLogger) Error(v ...interface{}) {
-	l.buffer.WriteString(timestamp() + errStr + fmt.Sprint(v...) + "\n")
+	l.write(timestamp() + errStr + fmt.Sprint(v...) + "\n")
 }
 
 func (l bufferLogger) Errorf(format string, v ...interface{}) {
-	l.buffer.WriteString(timestamp() + errStr + fmt.Sprintf(format, v...) + "\n")
+	l.write(timestamp() + errStr + fmt.Sprintf(format, v...) + "\n")
 }
 
 func (l bufferLogger) LogData() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.buffer == nil {
+		return ""
+	}
 	return l.buffer.String()
 }
 
@@ -13,7 +13,6 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"github.com/vmware/bosh-photon-cpi/cmd"
 	"github.com/vmware/bosh-photon-cpi/cpi"
 	"github.com/vmware/bosh-photon-cpi/logger"
 	"github.com/vmware/photon-controller-go-sdk/photon"
@@ -23,20 +22,36 @@ import (
 	"strings"
 )
 
+var actions = map[string]cpi.ActionFn{
+	"info":              Info,
+	"create_stemcell":   CreateStemcell,
+	"delete_stemcell":   DeleteStemcell,
+	"create_disk":       CreateDisk,
+	"delete_disk":       DeleteDisk,
+	"set_disk_metadata": SetDiskMetadata,
+	"has_disk":          HasDisk,
+	"get_disks":         GetDisks,
+	"resize_disk":       ResizeDisk,
+	"snapshot_disk":     SnapshotDisk,
+	"delete_snapshot":   DeleteSnapshot,
+	"attach_disk":       AttachDisk,
+	"detach_disk":       DetachDisk,
+	"create_vm":         CreateVM,
+	"delete_vm":         DeleteVM,
+	"has_vm":            HasVM,
+	"restart_vm":        RestartVM,
+	"set_vm_metadata":   SetVmMetadata,
+}
+
 func main() {
-	actions := map[string]cpi.ActionFn{
-		"create_stemcell": CreateStemcell,
-		"delete_stemcell": DeleteStemcell,
-		"create_disk":     CreateDisk,
-		"delete_disk":     DeleteDisk,
-		"has_disk":        HasDisk,
-		"attach_disk":     AttachDisk,
-		"detach_disk":     DetachDisk,
-		"create_vm":       CreateVM,
-		"delete_vm":       DeleteVM,
-		"has_vm":          HasVM,
-		"restart_vm":      RestartVM,
-		"set_vm_metadata": SetVmMetadata,
+	configPath := flag.String("configPath", "", "Path to photon config file")
+	registry := flag.Bool("registry", false, "Serve agent settings over HTTP instead of handling a CPI request")
+	flag.Parse()
+
+	if *registry {
+		err := runRegistry(*configPath)
+		os.Stderr.WriteString(fmt.Sprintf("Registry stopped: %v\n", err))
+		os.Exit(1)
 	}
 
 	var res []byte
@@ -55,10 +70,7 @@ func main() {
 		return
 	}
 
-	configPath := flag.String("configPath", "", "Path to photon config file")
-	flag.Parse()
-
-	context, err := loadConfig(*configPath)
+	context, err := loadConfig(*configPath, req.Context.Properties)
 	if err != nil {
 		res = createErrorResponse(cpi.NewCpiError(err, "Unable to load photon config from path '%s'", *configPath), "")
 		return
@@ -70,34 +82,70 @@ func main() {
 		os.Stderr.WriteString("Unable to create log file for photon CPI")
 	}
 
+	context.ApiVersion = negotiateApiVersion(req.ApiVersion)
+	context.RequestContext = req.Context
+
 	res = dispatch(context, actions, strings.ToLower(req.Method), req.Arguments)
 }
 
-func loadConfig(filePath string) (ctx *cpi.Context, err error) {
-	file, err := os.Open(filePath)
+// Requests without an api_version come from v1 directors. Never answer with a
+// newer version than this CPI supports.
+func negotiateApiVersion(requested int) int {
+	if requested < 1 {
+		return 1
+	}
+	if requested > apiVersion {
+		return apiVersion
+	}
+	return requested
+}
+
+// Loads the config file and overlays it with the CPI properties sent in the request
+// context, so that one director can target several Photon tenants and projects.
+func loadConfig(filePath string, properties map[string]interface{}) (ctx *cpi.Context, err error) {
+	config, err := readConfig(filePath, properties)
 	if err != nil {
 		return
 	}
-	config := &cpi.Config{}
-	err = json.NewDecoder(file).Decode(config)
+	log := logger.New()
+	client, err := newPhotonClient(config, log, 0)
 	if err != nil {
 		return
 	}
-	tokenOptions := &photon.TokenOptions{
-		AccessToken: config.Photon.Token}
-	clientConfig := &photon.ClientOptions{
-		IgnoreCertificate: config.Photon.IgnoreCertificate,
-		TokenOptions:      tokenOptions,
-	}
 	ctx = &cpi.Context{
-		Client: photon.NewClient(config.Photon.Target, "", clientConfig),
+		Client: client,
 		Config: config,
-		Runner: cmd.NewRunner(),
-		Logger: logger.New(),
+		Logger: log,
 	}
 	return
 }
 
+func readConfig(filePath string, properties map[string]interface{}) (config *cpi.Config, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	config = &cpi.Config{}
+	err = json.NewDecoder(file).Decode(config)
+	if err != nil {
+		return
+	}
+	if len(properties) > 0 {
+		// Decoding into the existing config only replaces the fields present in properties
+		propertiesJson, err := json.Marshal(properties)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(propertiesJson, config)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CPI properties in request context: %v", err)
+		}
+	}
+	_, err = settingsDelivery(config)
+	return
+}
+
 func dispatch(context *cpi.Context, actions map[string]cpi.ActionFn, method string, args []interface{}) (result []byte) {
 	// Attempt to recover from any panic that may occur during API calls
 	defer func() {
@@ -112,7 +160,10 @@ func dispatch(context *cpi.Context, actions map[string]cpi.ActionFn, method stri
 		}
 	}()
 	if fn, ok := actions[method]; ok {
+		context.Action = method
 		context.Logger.Infof("Begin action %s", method)
+		context.Logger.Infof("API version: %d, director UUID: '%s', request ID: '%s'",
+			context.ApiVersion, context.RequestContext.DirectorUUID, context.RequestContext.RequestID)
 		context.Logger.Infof("Raw action arguments: %#v", args)
 
 		res, err := fn(context, args)
@@ -129,7 +180,6 @@ func dispatch(context *cpi.Context, actions map[string]cpi.ActionFn, method stri
 		context.Logger.Error(e)
 		return createErrorResponse(e, context.Logger.LogData())
 	}
-	return
 }
 
 func createResponse(result interface{}, logData string) []byte {
@@ -149,28 +199,29 @@ func createErrorResponse(err error, logData string) []byte {
 		Log: logData,
 	}
 
+	res.Error.Type, res.Error.CanRetry = classifyError(err)
+
+	resBytes, err := json.Marshal(res)
+	if err != nil {
+		panic(err)
+	}
+	return resBytes
+}
+
+// Maps an error returned by an action to the BOSH error type and retry flag reported to the director
+func classifyError(err error) (errorType cpi.BoshErrorType, canRetry bool) {
 	switch t := err.(type) {
 	// If caller throws BoshError specifically, respect type and canRetry from caller
 	case cpi.BoshError:
-		res.Error.Type = t.Type()
-		res.Error.CanRetry = t.CanRetry()
+		return t.Type(), t.CanRetry()
 	// An API error or a task in error state cannot be retried
 	case photon.ApiError, photon.TaskError:
-		res.Error.Type = cpi.CloudError
-		res.Error.CanRetry = false
+		return cpi.CloudError, false
 	// Task timeout errors and unknown HTTP errors can likely be retried
 	case photon.HttpError, photon.TaskTimeoutError:
-		res.Error.Type = cpi.CloudError
-		res.Error.CanRetry = true
+		return cpi.CloudError, true
 	// Assume unknown errors are CPI errors that cannnot be retried
 	default:
-		res.Error.Type = cpi.CpiError
-		res.Error.CanRetry = false
+		return cpi.CpiError, false
 	}
-
-	resBytes, err := json.Marshal(res)
-	if err != nil {
-		panic(err)
-	}
-	return resBytes
 }
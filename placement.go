@@ -0,0 +1,344 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	ec "github.com/vmware/photon-controller-go-sdk/photon"
+	"sort"
+	"strings"
+)
+
+// VMs are tagged with the ID of the availability zone they were placed in, so that
+// disks created for them later can be placed in the same zone
+const availabilityZoneTagPrefix = "bosh-availability-zone:"
+
+// Resolves an availability zone given by name or ID to its ID
+func resolveAvailabilityZone(ctx *cpi.Context, nameOrID string) (id string, err error) {
+	zones, err := ctx.Client.AvailabilityZones.GetAll()
+	if err != nil {
+		return
+	}
+	matches := []string{}
+	for _, zone := range zones.Items {
+		if zone.ID == nameOrID {
+			return zone.ID, nil
+		}
+		if zone.Name == nameOrID {
+			matches = append(matches, zone.ID)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", cpi.NewBoshError(cpi.CloudError, false, "Availability zone '%s' not found", nameOrID)
+	case 1:
+		return matches[0], nil
+	}
+	return "", cpi.NewBoshError(cpi.CloudError, false,
+		"Availability zone name '%s' is ambiguous, use one of the IDs %v", nameOrID, matches)
+}
+
+// Host and datastore affinities CreateVM tries to place a VM with
+type placement struct {
+	affinities []ec.LocalitySpec
+	// Hints as given in cloud_properties, for error messages
+	description string
+}
+
+// Returns the placements to try for the host and datastore hints of cloud_properties, in
+// order. `host` and `datastore` pin the VM. Photon affinities are hard constraints, so the
+// `hosts` and `datastores` preferences are tried one entry at a time, and if photon can't
+// place the VM on any of them it is placed without the hint.
+func resolvePlacements(ctx *cpi.Context, cloudProps CloudProps) (placements []placement, err error) {
+	hostPlacements, err := resolveHostPlacements(ctx, cloudProps)
+	if err != nil {
+		return
+	}
+	// Photon doesn't list the datastores its hosts can reach, so datastores go through as
+	// given and CreateVM names them when photon can't place the VM
+	datastorePlacements := []placement{placement{}}
+	switch {
+	case cloudProps.Datastore != "":
+		datastorePlacements = []placement{datastorePlacement(cloudProps.Datastore)}
+	case len(cloudProps.Datastores) > 0:
+		datastorePlacements = []placement{}
+		for _, datastore := range cloudProps.Datastores {
+			datastorePlacements = append(datastorePlacements, datastorePlacement(datastore))
+		}
+		datastorePlacements = append(datastorePlacements, placement{})
+	}
+
+	for _, host := range hostPlacements {
+		for _, datastore := range datastorePlacements {
+			descriptions := []string{}
+			for _, description := range []string{host.description, datastore.description} {
+				if description != "" {
+					descriptions = append(descriptions, description)
+				}
+			}
+			placements = append(placements, placement{
+				affinities:  append(append([]ec.LocalitySpec{}, host.affinities...), datastore.affinities...),
+				description: strings.Join(descriptions, " and "),
+			})
+		}
+	}
+	return
+}
+
+// Unknown hosts are reported up front, photon would only fail the create task without
+// saying why. A pinned host that can't take VMs is an error too, preferred hosts that
+// can't are skipped.
+func resolveHostPlacements(ctx *cpi.Context, cloudProps CloudProps) (placements []placement, err error) {
+	if cloudProps.Host == "" && len(cloudProps.Hosts) == 0 {
+		return []placement{placement{}}, nil
+	}
+	hosts, err := ctx.Client.Hosts.GetAll()
+	if err != nil {
+		return
+	}
+	if cloudProps.Host != "" {
+		host, err := findHost(hosts.Items, cloudProps.Host)
+		if err != nil {
+			return nil, err
+		}
+		if host.State != "READY" {
+			return nil, cpi.NewBoshError(cpi.CloudError, false,
+				"Host '%s' is in state '%s' and can't run VMs", cloudProps.Host, host.State)
+		}
+		return []placement{hostPlacement(cloudProps.Host, host.ID)}, nil
+	}
+	for _, addressOrID := range cloudProps.Hosts {
+		host, err := findHost(hosts.Items, addressOrID)
+		if err != nil {
+			return nil, err
+		}
+		if host.State != "READY" {
+			ctx.Logger.Infof("Skipping host '%s' in state '%s'", addressOrID, host.State)
+			continue
+		}
+		placements = append(placements, hostPlacement(addressOrID, host.ID))
+	}
+	return append(placements, placement{}), nil
+}
+
+func findHost(hosts []ec.Host, addressOrID string) (*ec.Host, error) {
+	for i, host := range hosts {
+		if host.ID == addressOrID || host.Address == addressOrID {
+			return &hosts[i], nil
+		}
+	}
+	return nil, cpi.NewBoshError(cpi.CloudError, false, "Host '%s' not found", addressOrID)
+}
+
+func hostPlacement(addressOrID, id string) placement {
+	return placement{
+		affinities:  []ec.LocalitySpec{ec.LocalitySpec{Kind: "host", ID: id}},
+		description: fmt.Sprintf("host '%s'", addressOrID),
+	}
+}
+
+func datastorePlacement(datastore string) placement {
+	return placement{
+		affinities:  []ec.LocalitySpec{ec.LocalitySpec{Kind: "datastore", ID: datastore}},
+		description: fmt.Sprintf("datastore '%s'", datastore),
+	}
+}
+
+// A NIC of a VM on a photon network, and the BOSH network it belongs to
+type networkNIC struct {
+	boshName string
+	network  ec.Network
+}
+
+// Resolves the photon networks named in the cloud_properties of BOSH networks to the NICs
+// of the VM. The default gateway network comes first so it always gets the first NIC, the
+// rest follow in order of their BOSH names. Photon only puts a VM on the project default
+// network when no network is named, so named and unnamed networks can't be mixed.
+func resolveNetworks(ctx *cpi.Context, networks map[string]interface{}) (nics []networkNIC, err error) {
+	boshNames := []string{}
+	unnamed := []string{}
+	photonNames := map[string]string{}
+	defaults := map[string]bool{}
+	for boshName, settings := range networks {
+		network, err := parseNetwork(settings)
+		if err != nil {
+			return nil, err
+		}
+		if network.Type == "vip" {
+			continue
+		}
+		value, ok := network.CloudProperties["name"]
+		if !ok {
+			unnamed = append(unnamed, boshName)
+			continue
+		}
+		photonName, ok := value.(string)
+		if !ok || photonName == "" {
+			return nil, cpi.NewBoshError(cpi.CpiError, false,
+				"networks.%s.cloud_properties.name must be the name or ID of a photon network", boshName)
+		}
+		boshNames = append(boshNames, boshName)
+		photonNames[boshName] = photonName
+		for _, property := range network.Default {
+			defaults[boshName] = defaults[boshName] || property == "gateway"
+		}
+	}
+	if len(boshNames) == 0 {
+		return
+	}
+	if len(unnamed) > 0 {
+		sort.Strings(unnamed)
+		return nil, cpi.NewBoshError(cpi.CpiError, false,
+			"BOSH networks %v have no cloud_properties.name, but other networks do. "+
+				"VMs only get the project default network when no network is named", unnamed)
+	}
+	sort.Sort(&defaultGatewayFirst{boshNames, defaults})
+
+	photonNetworks, err := ctx.Client.Networks.GetAll(nil)
+	if err != nil {
+		return
+	}
+	for _, boshName := range boshNames {
+		network, err := findNetwork(photonNetworks.Items, photonNames[boshName])
+		if err != nil {
+			return nil, cpi.NewBoshError(cpi.CloudError, false, "BOSH network '%s': %v", boshName, err)
+		}
+		nics = append(nics, networkNIC{boshName, network})
+	}
+	return
+}
+
+func findNetwork(networks []ec.Network, nameOrID string) (network ec.Network, err error) {
+	matches := []ec.Network{}
+	for _, network := range networks {
+		if network.ID == nameOrID {
+			return network, nil
+		}
+		if network.Name == nameOrID {
+			matches = append(matches, network)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return network, fmt.Errorf("photon network '%s' not found", nameOrID)
+	case 1:
+		return matches[0], nil
+	}
+	ids := []string{}
+	for _, match := range matches {
+		ids = append(ids, match.ID)
+	}
+	return network, fmt.Errorf("photon network name '%s' is ambiguous, use one of the IDs %v", nameOrID, ids)
+}
+
+// Network connections photon reports in the result of a VM's get networks task
+type vmNetworks struct {
+	NetworkConnections []struct {
+		Network    string `json:"network"`
+		MACAddress string `json:"macAddress"`
+	} `json:"networkConnections"`
+}
+
+// Sets the MAC of each BOSH network's NIC in its network settings, so the agent knows which
+// NIC to configure for which network. Photon doesn't promise to create the NICs of a VM in
+// the order they were asked for.
+func setNetworkMACs(ctx *cpi.Context, vmID string, nics []networkNIC, networks map[string]interface{}) (err error) {
+	if len(nics) == 0 {
+		return
+	}
+	ctx.Logger.Infof("Getting networks of VM: %s", vmID)
+	task, err := ctx.Client.VMs.GetNetworks(vmID)
+	if err != nil {
+		return
+	}
+	task, err = waitForTask(ctx, task.ID)
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(task.ResourceProperties)
+	if err != nil {
+		return
+	}
+	connections := &vmNetworks{}
+	err = json.Unmarshal(data, connections)
+	if err != nil {
+		return
+	}
+
+	used := map[int]bool{}
+	for _, nic := range nics {
+		mac := ""
+		for i, connection := range connections.NetworkConnections {
+			if !used[i] && connection.MACAddress != "" && isOnNetwork(nic.network, connection.Network) {
+				used[i] = true
+				mac = connection.MACAddress
+				break
+			}
+		}
+		if mac == "" {
+			return cpi.NewBoshError(cpi.CloudError, false,
+				"Could not find the NIC of BOSH network '%s' on photon network '%s' of VM %s",
+				nic.boshName, nic.network.Name, vmID)
+		}
+		networks[nic.boshName].(map[string]interface{})["mac"] = mac
+	}
+	return
+}
+
+// Network connections name the network by ID, name or the port group backing it
+func isOnNetwork(network ec.Network, connectionNetwork string) bool {
+	if connectionNetwork == network.ID || connectionNetwork == network.Name {
+		return true
+	}
+	for _, portGroup := range network.PortGroups {
+		if connectionNetwork == portGroup {
+			return true
+		}
+	}
+	return false
+}
+
+// Sorts BOSH network names with the network that has the default gateway first
+type defaultGatewayFirst struct {
+	names    []string
+	defaults map[string]bool
+}
+
+func (s *defaultGatewayFirst) Len() int {
+	return len(s.names)
+}
+
+func (s *defaultGatewayFirst) Swap(i, j int) {
+	s.names[i], s.names[j] = s.names[j], s.names[i]
+}
+
+func (s *defaultGatewayFirst) Less(i, j int) bool {
+	iDefault, jDefault := s.defaults[s.names[i]], s.defaults[s.names[j]]
+	if iDefault != jDefault {
+		return iDefault
+	}
+	return s.names[i] < s.names[j]
+}
+
+// Returns the ID of the availability zone a VM was placed in, or "" if it wasn't placed in one
+func vmAvailabilityZone(vm *ec.VM) string {
+	for _, tag := range vm.Tags {
+		if strings.HasPrefix(tag, availabilityZoneTagPrefix) {
+			return strings.TrimPrefix(tag, availabilityZoneTagPrefix)
+		}
+	}
+	return ""
+}
+
+func availabilityZoneAffinity(id string) ec.LocalitySpec {
+	return ec.LocalitySpec{Kind: "availabilityZone", ID: id}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	"github.com/vmware/bosh-photon-cpi/logger"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Unlike a CPI action the registry runs for as long as the director does, so it has to
+// log in to photon again whenever its token expires. Logins are still rate limited so a
+// token photon keeps rejecting doesn't turn every request into a login.
+const registryReloginInterval = time.Minute
+
+// Response of the registry, in the format bosh-agent expects from the BOSH registry
+type registryResponse struct {
+	Settings string `json:"settings,omitempty"`
+	Status   string `json:"status"`
+}
+
+// Serves agent settings stored in VM metadata at GET /instances/<vm id>/settings.
+// Attach and detach disk update the metadata, so agents always get current settings.
+type registryHandler struct {
+	ctx *cpi.Context
+}
+
+func runRegistry(configPath string) (err error) {
+	config, err := readConfig(configPath, nil)
+	if err != nil {
+		return
+	}
+	if config.Registry == nil || config.Registry.Address == "" {
+		return errors.New("Registry requires registry.address in the config")
+	}
+	// Settings contain mbus and blobstore credentials, never serve them without auth
+	if config.Registry.User == "" || config.Registry.Password == "" {
+		return errors.New("Registry requires registry.user and registry.password in the config")
+	}
+	tlsCert, tlsKey := config.Registry.TLSCert, config.Registry.TLSKey
+	if (tlsCert == "") != (tlsKey == "") {
+		return errors.New("Registry requires both registry.tls_cert and registry.tls_key to serve HTTPS")
+	}
+
+	log := logger.NewStream(os.Stderr)
+	client, err := newPhotonClient(config, log, registryReloginInterval)
+	if err != nil {
+		return
+	}
+	ctx := &cpi.Context{
+		Client: client,
+		Config: config,
+		Logger: log,
+		Action: "registry",
+	}
+	handler := &registryHandler{ctx}
+	if tlsCert != "" {
+		log.Infof("Serving agent settings over HTTPS on %s", config.Registry.Address)
+		return http.ListenAndServeTLS(config.Registry.Address, tlsCert, tlsKey, handler)
+	}
+	// Basic auth keeps out other clients, but without TLS the settings and the registry
+	// password can still be read off the network
+	log.Infof("Serving agent settings over plaintext HTTP on %s", config.Registry.Address)
+	return http.ListenAndServe(config.Registry.Address, handler)
+}
+
+func (h *registryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	config := h.ctx.Config.Registry
+	user, password, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(config.User)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(config.Password)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="BOSH Registry"`)
+		h.respond(w, http.StatusUnauthorized, &registryResponse{Status: "unauthorized"})
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 3 || parts[0] != "instances" || parts[1] == "" || parts[2] != "settings" {
+		h.respond(w, http.StatusNotFound, &registryResponse{Status: "not_found"})
+		return
+	}
+	if r.Method != "GET" {
+		h.respond(w, http.StatusMethodNotAllowed, &registryResponse{Status: "method_not_allowed"})
+		return
+	}
+
+	vmID := parts[1]
+	vm, err := h.ctx.Client.VMs.Get(vmID)
+	if isNotFoundError(err) {
+		h.respond(w, http.StatusNotFound, &registryResponse{Status: "not_found"})
+		return
+	}
+	if err != nil {
+		h.ctx.Logger.Errorf("Failed to get settings of VM %s: %v", vmID, err)
+		h.respond(w, http.StatusInternalServerError, &registryResponse{Status: "error"})
+		return
+	}
+	settings, ok := vm.Metadata[metadataKey]
+	if !ok {
+		h.respond(w, http.StatusNotFound, &registryResponse{Status: "not_found"})
+		return
+	}
+	h.ctx.Logger.Infof("Serving settings of VM %s to %s", vmID, r.RemoteAddr)
+	h.respond(w, http.StatusOK, &registryResponse{Settings: settings, Status: "ok"})
+}
+
+func (h *registryHandler) respond(w http.ResponseWriter, status int, res *registryResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(res)
+	if err != nil {
+		h.ctx.Logger.Errorf("Failed to write registry response: %v", err)
+	}
+}
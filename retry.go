@@ -0,0 +1,145 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	"github.com/vmware/bosh-photon-cpi/logger"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	retryMaxAttemptsDefault    = 3
+	retryInitialBackoffDefault = time.Second
+	retryMaxBackoffDefault     = 30 * time.Second
+	retryJitterDefault         = 0.2
+)
+
+// Round tripper that repeats photon requests failing with transient errors, backing off
+// exponentially between attempts. Requests are only repeated when it is safe to do so,
+// see canRetry.
+type retryTransport struct {
+	transport      http.RoundTripper
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	jitter         float64
+	logger         logger.Logger
+	sleep          func(time.Duration)
+}
+
+func newRetryTransport(transport http.RoundTripper, config *cpi.RetryConfig, log logger.Logger) *retryTransport {
+	t := &retryTransport{
+		transport:      transport,
+		maxAttempts:    retryMaxAttemptsDefault,
+		initialBackoff: retryInitialBackoffDefault,
+		maxBackoff:     retryMaxBackoffDefault,
+		jitter:         retryJitterDefault,
+		logger:         log,
+		sleep:          time.Sleep,
+	}
+	if config != nil {
+		if config.MaxAttempts != 0 {
+			t.maxAttempts = config.MaxAttempts
+		}
+		if config.InitialBackoff != 0 {
+			t.initialBackoff = time.Duration(config.InitialBackoff)
+		}
+		if config.MaxBackoff != 0 {
+			t.maxBackoff = time.Duration(config.MaxBackoff)
+		}
+		if config.Jitter != nil {
+			t.jitter = *config.Jitter
+		}
+	}
+	return t
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (res *http.Response, err error) {
+	for attempt := 1; ; attempt++ {
+		r := req
+		if attempt > 1 && req.GetBody != nil {
+			r = req.Clone(req.Context())
+			r.Body, err = req.GetBody()
+			if err != nil {
+				return
+			}
+		}
+		res, err = t.transport.RoundTrip(r)
+		if attempt >= t.maxAttempts || !canRetry(req, res, err) {
+			return
+		}
+
+		backoff := t.backoff(attempt)
+		if err != nil {
+			t.logger.Errorf("Photon request %s %s failed: %v, retrying in %v (attempt %d of %d)",
+				req.Method, req.URL.Path, err, backoff, attempt+1, t.maxAttempts)
+		} else {
+			t.logger.Errorf("Photon request %s %s returned HTTP %d, retrying in %v (attempt %d of %d)",
+				req.Method, req.URL.Path, res.StatusCode, backoff, attempt+1, t.maxAttempts)
+			res.Body.Close()
+		}
+		t.sleep(backoff)
+	}
+}
+
+// Returns the delay before the attempt following the given one
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	backoff := float64(t.initialBackoff) * math.Pow(2, float64(attempt-1))
+	if backoff > float64(t.maxBackoff) {
+		backoff = float64(t.maxBackoff)
+	}
+	backoff *= 1 + t.jitter*(2*rand.Float64()-1)
+	return time.Duration(backoff)
+}
+
+// Indicates whether a failed request can be sent again. Requests whose body can't be
+// read twice, e.g. stemcell uploads, are never repeated. Idempotent requests are repeated
+// on network errors and gateway errors. Other requests, e.g. creating a VM, are only
+// repeated when photon can't have acted on them: the connection was never established or
+// photon refused the request as unavailable.
+func canRetry(req *http.Request, res *http.Response, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		// Certificate problems won't go away by trying again
+		var certErr *tls.CertificateVerificationError
+		if errors.As(err, &certErr) {
+			return false
+		}
+		if isIdempotent(req.Method) {
+			return true
+		}
+		var opErr *net.OpError
+		return errors.As(err, &opErr) && opErr.Op == "dial"
+	}
+	switch res.StatusCode {
+	case http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return isIdempotent(req.Method)
+	}
+	return false
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	"github.com/vmware/bosh-photon-cpi/logger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Retry", func() {
+	var (
+		server    *httptest.Server
+		log       logger.Logger
+		transport *retryTransport
+		client    *http.Client
+		statuses  []int
+		bodies    []string
+		sleeps    []time.Duration
+		mutex     sync.Mutex
+	)
+
+	BeforeEach(func() {
+		statuses = []int{}
+		bodies = []string{}
+		sleeps = []time.Duration{}
+		log = logger.New()
+
+		// Responds with the queued statuses in order, then with 200
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+			status := http.StatusOK
+			if len(statuses) > 0 {
+				status, statuses = statuses[0], statuses[1:]
+			}
+			w.WriteHeader(status)
+		}))
+
+		jitter := 0.0
+		config := &cpi.RetryConfig{
+			MaxAttempts:    3,
+			InitialBackoff: cpi.Duration(time.Second),
+			MaxBackoff:     cpi.Duration(90 * time.Second),
+			Jitter:         &jitter,
+		}
+		transport = newRetryTransport(http.DefaultTransport, config, log)
+		transport.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+		client = &http.Client{Transport: transport}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("retries GET requests on HTTP 503 with exponential backoff", func() {
+		statuses = []int{503, 503}
+		res, err := client.Get(server.URL + "/vms/fake-vm-id")
+
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(res.StatusCode).Should(Equal(200))
+		Expect(bodies).Should(HaveLen(3))
+		Expect(sleeps).Should(Equal([]time.Duration{time.Second, 2 * time.Second}))
+		Expect(log.LogData()).Should(ContainSubstring("GET /vms/fake-vm-id returned HTTP 503, retrying"))
+	})
+	It("gives up after the maximum number of attempts", func() {
+		statuses = []int{504, 504, 504, 504}
+		res, err := client.Get(server.URL + "/vms/fake-vm-id")
+
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(res.StatusCode).Should(Equal(504))
+		Expect(bodies).Should(HaveLen(3))
+	})
+	It("does not retry client errors", func() {
+		statuses = []int{404}
+		res, err := client.Get(server.URL + "/vms/fake-vm-id")
+
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(res.StatusCode).Should(Equal(404))
+		Expect(bodies).Should(HaveLen(1))
+	})
+	It("retries POST requests refused with HTTP 503 and sends the same body", func() {
+		statuses = []int{503}
+		res, err := client.Post(server.URL+"/vms/fake-vm-id/detach_disk", "application/json",
+			bytes.NewReader([]byte(`{"diskId":"fake-disk-id"}`)))
+
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(res.StatusCode).Should(Equal(200))
+		Expect(bodies).Should(Equal([]string{`{"diskId":"fake-disk-id"}`, `{"diskId":"fake-disk-id"}`}))
+	})
+	It("does not retry POST requests on gateway errors", func() {
+		statuses = []int{502}
+		res, err := client.Post(server.URL+"/projects/fake-project-id/vms", "application/json",
+			bytes.NewReader([]byte(`{}`)))
+
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(res.StatusCode).Should(Equal(502))
+		Expect(bodies).Should(HaveLen(1))
+	})
+	It("does not retry requests with a body that can't be read again", func() {
+		statuses = []int{503}
+		body := ioutil.NopCloser(bytes.NewReader([]byte("stemcell")))
+		req, err := http.NewRequest("POST", server.URL+"/images", body)
+		Expect(err).ShouldNot(HaveOccurred())
+		res, err := client.Do(req)
+
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(res.StatusCode).Should(Equal(503))
+		Expect(bodies).Should(HaveLen(1))
+	})
+	It("retries requests that could not connect", func() {
+		url := server.URL
+		server.Close()
+		_, err := client.Post(url+"/projects/fake-project-id/vms", "application/json", bytes.NewReader([]byte(`{}`)))
+
+		Expect(err).Should(HaveOccurred())
+		Expect(sleeps).Should(HaveLen(2))
+	})
+	It("caps the backoff and applies jitter", func() {
+		transport.maxBackoff = 3 * time.Second
+		Expect(transport.backoff(1)).Should(Equal(time.Second))
+		Expect(transport.backoff(2)).Should(Equal(2 * time.Second))
+		Expect(transport.backoff(3)).Should(Equal(3 * time.Second))
+
+		transport.jitter = 0.5
+		for i := 0; i < 10; i++ {
+			Expect(transport.backoff(1)).Should(BeNumerically(">=", 500*time.Millisecond))
+			Expect(transport.backoff(1)).Should(BeNumerically("<=", 1500*time.Millisecond))
+		}
+	})
+	It("uses defaults without config", func() {
+		t := newRetryTransport(http.DefaultTransport, nil, log)
+		Expect(t.maxAttempts).Should(Equal(retryMaxAttemptsDefault))
+		Expect(t.initialBackoff).Should(Equal(retryInitialBackoffDefault))
+		Expect(t.maxBackoff).Should(Equal(retryMaxBackoffDefault))
+		Expect(t.jitter).Should(Equal(retryJitterDefault))
+	})
+})
@@ -0,0 +1,56 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"github.com/vmware/bosh-photon-cpi/cpi"
+)
+
+// Photon exposes neither a disk snapshot nor a disk clone API, so snapshots cannot be
+// taken. Both actions validate their arguments, then report NotImplemented, which the
+// director treats as snapshots being disabled for this CPI.
+
+func SnapshotDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
+	if len(args) < 1 {
+		return nil, errors.New("Expected at least 1 argument")
+	}
+	diskCID, ok := args[0].(string)
+	if !ok {
+		return nil, errors.New("Unexpected argument where disk_cid should be")
+	}
+	metadata := map[string]interface{}{}
+	if len(args) > 1 && args[1] != nil {
+		metadata, ok = args[1].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Unexpected argument where metadata should be")
+		}
+	}
+
+	ctx.Logger.Infof("SnapshotDisk with disk_cid: '%s', metadata: '%v'", diskCID, metadata)
+
+	return nil, cpi.NewBoshError(cpi.NotImplementedError, false,
+		"Photon does not support snapshots of persistent disk %s", diskCID)
+}
+
+func DeleteSnapshot(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
+	if len(args) < 1 {
+		return nil, errors.New("Expected at least 1 argument")
+	}
+	snapshotCID, ok := args[0].(string)
+	if !ok {
+		return nil, errors.New("Unexpected argument where snapshot_cid should be")
+	}
+
+	ctx.Logger.Infof("DeleteSnapshot with snapshot_cid: '%s'", snapshotCID)
+
+	return nil, cpi.NewBoshError(cpi.NotImplementedError, false,
+		"Photon does not support snapshots, cannot delete snapshot %s", snapshotCID)
+}
@@ -27,7 +27,7 @@ func CreateStemcell(ctx *cpi.Context, args []interface{}) (result interface{}, e
 		return nil, errors.New("Unexpected argument where image_path should be")
 	}
 
-	ctx.Logger.Infof("CreateStemcell with imagePath: '%s', imagePath")
+	ctx.Logger.Infof("CreateStemcell with imagePath: '%s'", imagePath)
 
 	ctx.Logger.Info("Reading stemcell from disk")
 	stemcell, err := newStemcell(imagePath)
@@ -43,7 +43,7 @@ func CreateStemcell(ctx *cpi.Context, args []interface{}) (result interface{}, e
 	}
 
 	ctx.Logger.Infof("Waiting on task: %#v", task)
-	task, err = ctx.Client.Tasks.Wait(task.ID)
+	task, err = waitForTask(ctx, task.ID)
 	if err != nil {
 		return
 	}
@@ -63,12 +63,16 @@ func DeleteStemcell(ctx *cpi.Context, args []interface{}) (result interface{}, e
 
 	ctx.Logger.Info("Beginning stemcell deletion")
 	task, err := ctx.Client.Images.Delete(stemcellCID)
+	if isNotFoundError(err) {
+		ctx.Logger.Infof("Stemcell '%s' not found, nothing to delete", stemcellCID)
+		return nil, nil
+	}
 	if err != nil {
 		return
 	}
 
 	ctx.Logger.Infof("Waiting on task: %#v", task)
-	task, err = ctx.Client.Tasks.Wait(task.ID)
+	task, err = waitForTask(ctx, task.ID)
 	if err != nil {
 		return
 	}
@@ -155,7 +155,7 @@ var _ = Describe("Stemcell", func() {
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(res.Log).ShouldNot(BeEmpty())
 		})
-		It("returns an error for missing stemcell delete", func() {
+		It("returns nothing for missing stemcell delete", func() {
 			deleteTask := &ec.Task{Operation: "DELETE_IMAGE", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-image-id"}}
 			completedTask := &ec.Task{Operation: "DELETE_IMAGE", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-image-id"}}
 
@@ -175,9 +175,9 @@ var _ = Describe("Stemcell", func() {
 			res, err := GetResponse(dispatch(ctx, actions, "delete_stemcell", args))
 
 			Expect(res.Result).Should(BeNil())
-			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error).Should(BeNil())
 			Expect(err).ShouldNot(HaveOccurred())
-			Expect(res.Log).ShouldNot(BeEmpty())
+			Expect(res.Log).Should(ContainSubstring("Stemcell 'fake-image-id' not found"))
 		})
 		It("should return an error when given no arguments", func() {
 			actions := map[string]cpi.ActionFn{
@@ -10,9 +10,96 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"github.com/vmware/bosh-photon-cpi/cpi"
+	ec "github.com/vmware/photon-controller-go-sdk/photon"
+	"sort"
 )
 
 func SetVmMetadata(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
+	if len(args) < 2 {
+		return nil, errors.New("Expected at least 2 arguments")
+	}
+	vmCID, ok := args[0].(string)
+	if !ok {
+		return nil, errors.New("Unexpected argument where vm_cid should be")
+	}
+	boshMetadata, ok := args[1].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Unexpected argument where metadata should be")
+	}
+
+	ctx.Logger.Infof("SetVmMetadata with vm_cid: '%s', metadata: '%v'", vmCID, boshMetadata)
+
+	metadataConfig := ctx.Config.Metadata
+	if metadataConfig == nil {
+		metadataConfig = &cpi.MetadataConfig{}
+	}
+
+	ctx.Logger.Info("Getting metadata for VM")
+	vm, err := ctx.Client.VMs.Get(vmCID)
+	if err != nil {
+		return
+	}
+
+	// SetMetadata replaces all metadata on the VM, so start from what's already there
+	// to keep the agent env owned by putAgentEnvMetadata.
+	metadata := &ec.VmMetadata{Metadata: map[string]string{}}
+	for key, value := range vm.Metadata {
+		metadata.Metadata[key] = value
+	}
+	for key, value := range boshMetadata {
+		photonKey := metadataConfig.KeyPrefix + key
+		if photonKey == metadataKey {
+			ctx.Logger.Errorf("Ignoring metadata key '%s', it is reserved for the CPI", photonKey)
+			continue
+		}
+		metadata.Metadata[photonKey] = fmt.Sprint(value)
+	}
+
+	ctx.Logger.Infof("Setting metadata for VM: %#v", metadata)
+	// Task returns instantly for SetMetadata
+	_, err = ctx.Client.VMs.SetMetadata(vmCID, metadata)
+	if err != nil {
+		return
+	}
+
+	for _, tag := range metadataTags(metadataConfig, boshMetadata) {
+		if hasTag(vm.Tags, tag) {
+			continue
+		}
+		ctx.Logger.Infof("Setting tag for VM: %s", tag)
+		task, err := ctx.Client.VMs.SetTag(vmCID, &ec.VmTag{Tag: tag})
+		if err != nil {
+			return nil, err
+		}
+		ctx.Logger.Infof("Waiting on task: %#v", task)
+		_, err = waitForTask(ctx, task.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return nil, nil
 }
+
+// Returns the VM tags, formatted as "<prefix><key>=<value>", for the configured tag keys
+// that are present in the BOSH metadata. Tags are sorted so they are applied in a stable order.
+func metadataTags(config *cpi.MetadataConfig, boshMetadata map[string]interface{}) (tags []string) {
+	for _, key := range config.TagKeys {
+		if value, ok := boshMetadata[key]; ok {
+			tags = append(tags, fmt.Sprintf("%s%s=%v", config.KeyPrefix, key, value))
+		}
+	}
+	sort.Strings(tags)
+	return
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -10,30 +10,178 @@
 package main
 
 import (
+	"encoding/json"
 	"github.com/vmware/bosh-photon-cpi/cpi"
 	"github.com/vmware/bosh-photon-cpi/logger"
 	. "github.com/vmware/bosh-photon-cpi/mocks"
+	ec "github.com/vmware/photon-controller-go-sdk/photon"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
 )
 
 var _ = Describe("VM metadata", func() {
 	var (
-		ctx *cpi.Context
+		server   *httptest.Server
+		ctx      *cpi.Context
+		vm       *ec.VM
+		metadata *ec.VmMetadata
+		tags     []string
 	)
 
 	BeforeEach(func() {
+		server = NewMockServer()
+		Activate(true)
+		httpClient := &http.Client{Transport: DefaultMockTransport}
 		ctx = &cpi.Context{
+			Client: ec.NewTestClient(server.URL, "", nil, httpClient),
+			Config: &cpi.Config{
+				Photon: &cpi.PhotonConfig{
+					Target:    server.URL,
+					ProjectID: "fake-project-id",
+				},
+			},
 			Logger: logger.New(),
 		}
+
+		vm = &ec.VM{
+			ID:       "fake-vm-id",
+			Metadata: map[string]string{"bosh-cpi": "fake-agent-env"},
+			Tags:     []string{"job=fake-job"},
+		}
+		metadata = nil
+		tags = []string{}
+		metadataTask := &ec.Task{State: "COMPLETED"}
+		tagTask := &ec.Task{Operation: "SET_TAG", State: "QUEUED", ID: "fake-tag-task-id"}
+		tagCompletedTask := &ec.Task{Operation: "SET_TAG", State: "COMPLETED", ID: "fake-tag-task-id"}
+
+		RegisterResponder(
+			"GET",
+			server.URL+"/vms/"+vm.ID,
+			CreateResponder(200, ToJson(vm)))
+		RegisterResponder(
+			"POST",
+			server.URL+"/vms/"+vm.ID+"/set_metadata",
+			func(req *http.Request) (*http.Response, error) {
+				metadata = &ec.VmMetadata{}
+				err := json.NewDecoder(req.Body).Decode(metadata)
+				Expect(err).ToNot(HaveOccurred())
+				return CreateResponder(200, ToJson(metadataTask))(req)
+			})
+		RegisterResponder(
+			"POST",
+			server.URL+"/vms/"+vm.ID+"/tags",
+			func(req *http.Request) (*http.Response, error) {
+				tag := &ec.VmTag{}
+				err := json.NewDecoder(req.Body).Decode(tag)
+				Expect(err).ToNot(HaveOccurred())
+				tags = append(tags, tag.Tag)
+				return CreateResponder(200, ToJson(tagTask))(req)
+			})
+		RegisterResponder(
+			"GET",
+			server.URL+"/tasks/"+tagTask.ID,
+			CreateResponder(200, ToJson(tagCompletedTask)))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("merges BOSH metadata into VM metadata", func() {
+		actions := map[string]cpi.ActionFn{
+			"set_vm_metadata": SetVmMetadata,
+		}
+		args := []interface{}{
+			"fake-vm-id",
+			map[string]interface{}{"deployment": "fake-deployment", "job": "fake-job", "index": 0.0},
+		}
+		res, err := GetResponse(dispatch(ctx, actions, "set_vm_metadata", args))
+
+		Expect(res.Result).To(BeNil())
+		Expect(res.Error).To(BeNil())
+		Expect(err).To(BeNil())
+		Expect(res.Log).ShouldNot(BeEmpty())
+		Expect(metadata.Metadata).Should(Equal(map[string]string{
+			"bosh-cpi":   "fake-agent-env",
+			"deployment": "fake-deployment",
+			"job":        "fake-job",
+			"index":      "0",
+		}))
+		Expect(tags).Should(BeEmpty())
 	})
+	It("prefixes keys and copies configured keys into tags", func() {
+		ctx.Config.Metadata = &cpi.MetadataConfig{
+			KeyPrefix: "bosh-",
+			TagKeys:   []string{"deployment", "director"},
+		}
+		actions := map[string]cpi.ActionFn{
+			"set_vm_metadata": SetVmMetadata,
+		}
+		args := []interface{}{
+			"fake-vm-id",
+			map[string]interface{}{"deployment": "fake-deployment", "name": "fake-job/0"},
+		}
+		res, err := GetResponse(dispatch(ctx, actions, "set_vm_metadata", args))
 
-	It("set_vm_metadata is a nop", func() {
+		Expect(res.Error).To(BeNil())
+		Expect(err).To(BeNil())
+		Expect(metadata.Metadata).Should(Equal(map[string]string{
+			"bosh-cpi":        "fake-agent-env",
+			"bosh-deployment": "fake-deployment",
+			"bosh-name":       "fake-job/0",
+		}))
+		Expect(tags).Should(Equal([]string{"bosh-deployment=fake-deployment"}))
+	})
+	It("does not clobber the agent env key", func() {
+		ctx.Config.Metadata = &cpi.MetadataConfig{KeyPrefix: "bosh-"}
+		actions := map[string]cpi.ActionFn{
+			"set_vm_metadata": SetVmMetadata,
+		}
+		args := []interface{}{"fake-vm-id", map[string]interface{}{"cpi": "oops"}}
+		res, err := GetResponse(dispatch(ctx, actions, "set_vm_metadata", args))
+
+		Expect(res.Error).To(BeNil())
+		Expect(err).To(BeNil())
+		Expect(metadata.Metadata).Should(Equal(map[string]string{"bosh-cpi": "fake-agent-env"}))
+	})
+	It("skips tags that are already set on the VM", func() {
+		ctx.Config.Metadata = &cpi.MetadataConfig{TagKeys: []string{"job"}}
+		actions := map[string]cpi.ActionFn{
+			"set_vm_metadata": SetVmMetadata,
+		}
+		args := []interface{}{"fake-vm-id", map[string]interface{}{"job": "fake-job"}}
+		res, err := GetResponse(dispatch(ctx, actions, "set_vm_metadata", args))
+
+		Expect(res.Error).To(BeNil())
+		Expect(err).To(BeNil())
+		Expect(tags).Should(BeEmpty())
+	})
+	It("returns an error when VM not found", func() {
+		RegisterResponder(
+			"GET",
+			server.URL+"/vms/missing-vm-id",
+			CreateResponder(404, ToJson(ec.ApiError{Code: "VmNotFound"})))
+
+		actions := map[string]cpi.ActionFn{
+			"set_vm_metadata": SetVmMetadata,
+		}
+		args := []interface{}{"missing-vm-id", map[string]interface{}{"job": "fake-job"}}
+		res, err := GetResponse(dispatch(ctx, actions, "set_vm_metadata", args))
+
+		Expect(res.Result).To(BeNil())
+		Expect(res.Error).ToNot(BeNil())
+		Expect(err).To(BeNil())
+	})
+	It("should return an error when given no arguments", func() {
 		actions := map[string]cpi.ActionFn{
 			"set_vm_metadata": SetVmMetadata,
 		}
 		res, err := GetResponse(dispatch(ctx, actions, "set_vm_metadata", nil))
+
 		Expect(res.Result).To(BeNil())
+		Expect(res.Error).ToNot(BeNil())
 		Expect(err).To(BeNil())
 		Expect(res.Log).ShouldNot(BeEmpty())
 	})
@@ -11,7 +11,9 @@ package main
 
 import (
 	"errors"
-	"net/http"
+	"fmt"
+	"strings"
+	"sync"
 
 	"github.com/vmware/bosh-photon-cpi/cpi"
 	ec "github.com/vmware/photon-controller-go-sdk/photon"
@@ -21,6 +23,11 @@ type CloudProps struct {
 	VMFlavor             string
 	DiskFlavor           string
 	VMAttachedDiskSizeGB int
+	AvailabilityZone     string
+	Host                 string
+	Hosts                []string
+	Datastore            string
+	Datastores           []string
 }
 
 const (
@@ -28,6 +35,14 @@ const (
 	DiskFlavorElement           = "disk_flavor"
 	VMFlavorElement             = "vm_flavor"
 	VMAttachedDiskSizeGBElement = "vm_attached_disk_size_gb"
+	AvailabilityZoneElement     = "availability_zone"
+	HostElement                 = "host"
+	HostsElement                = "hosts"
+	DatastoreElement            = "datastore"
+	DatastoresElement           = "datastores"
+
+	// Number of persistent disks delete_vm detaches at the same time
+	detachDiskWorkers = 4
 )
 
 var ErrCloudPropsValues = errors.New("error in cloud props properties")
@@ -44,12 +59,54 @@ func ParseCloudProps(cloudPropsMap map[string]interface{}) (cloudProps CloudProp
 	if _, ok := cloudPropsMap[VMAttachedDiskSizeGBElement]; ok {
 		cloudProps.VMAttachedDiskSizeGB = int(cloudPropsMap[VMAttachedDiskSizeGBElement].(float64))
 	}
-	if !diskOk || !vmOk {
+	azOk := true
+	if _, ok := cloudPropsMap[AvailabilityZoneElement]; ok {
+		cloudProps.AvailabilityZone, azOk = cloudPropsMap[AvailabilityZoneElement].(string)
+	}
+	hostOk := true
+	if _, ok := cloudPropsMap[HostElement]; ok {
+		cloudProps.Host, hostOk = cloudPropsMap[HostElement].(string)
+		hostOk = hostOk && cloudProps.Host != ""
+	}
+	datastoreOk := true
+	if _, ok := cloudPropsMap[DatastoreElement]; ok {
+		cloudProps.Datastore, datastoreOk = cloudPropsMap[DatastoreElement].(string)
+		datastoreOk = datastoreOk && cloudProps.Datastore != ""
+	}
+	var hostsOk, datastoresOk bool
+	cloudProps.Hosts, hostsOk = parseStringList(cloudPropsMap, HostsElement)
+	cloudProps.Datastores, datastoresOk = parseStringList(cloudPropsMap, DatastoresElement)
+	// A VM is either pinned or given preferences, setting both is ambiguous
+	if (cloudProps.Host != "" && cloudProps.Hosts != nil) || (cloudProps.Datastore != "" && cloudProps.Datastores != nil) {
+		hostsOk, datastoresOk = false, false
+	}
+	if !diskOk || !vmOk || !azOk || !hostOk || !datastoreOk || !hostsOk || !datastoresOk {
 		err = ErrCloudPropsValues
 	}
 	return
 }
 
+// Reads a list of non-empty strings, a missing list reads as nil
+func parseStringList(cloudPropsMap map[string]interface{}, name string) (values []string, ok bool) {
+	value, present := cloudPropsMap[name]
+	if !present {
+		return nil, true
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	values = []string{}
+	for _, item := range items {
+		value, ok := item.(string)
+		if !ok || value == "" {
+			return nil, false
+		}
+		values = append(values, value)
+	}
+	return values, true
+}
+
 func CreateVM(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
 	if len(args) < 6 {
 		return nil, errors.New("Expected at least 6 arguments")
@@ -76,21 +133,43 @@ func CreateVM(ctx *cpi.Context, args []interface{}) (result interface{}, err err
 	if !ok {
 		return nil, errors.New("Unexpected argument where networks should be")
 	}
-	// Ignore args[4] for now, which is disk_cids
+	diskCIDs, err := parseDiskCIDs(args[4])
+	if err != nil {
+		return
+	}
 	env, ok := args[5].(map[string]interface{})
 	if !ok {
 		return nil, errors.New("Unexpected argument where env should be")
 	}
 
 	ctx.Logger.Infof(
-		"CreateVM with agent_id: '%v', stemcell_cid: '%v', cloud_properties: '%v', networks: '%v', env: '%v'",
-		agentID, stemcellCID, cloudProps, networks, env)
+		"CreateVM with agent_id: '%v', stemcell_cid: '%v', cloud_properties: '%v', networks: '%v', disk_cids: '%v', env: '%v'",
+		agentID, stemcellCID, cloudProps, networks, diskCIDs, env)
+
+	delivery, err := settingsDelivery(ctx.Config)
+	if err != nil {
+		return
+	}
+	// Catch bad networks before there is a VM to clean up
+	err = validateNetworks(networks)
+	if err != nil {
+		return
+	}
+	nics, err := resolveNetworks(ctx, networks)
+	if err != nil {
+		return
+	}
+	var networkIDs []string
+	for _, nic := range nics {
+		networkIDs = append(networkIDs, nic.network.ID)
+	}
 
 	ephDiskName := "bosh-ephemeral-disk"
 	spec := &ec.VmCreateSpec{
 		Name:          "bosh-vm",
 		Flavor:        cloudProps.VMFlavor,
 		SourceImageID: stemcellCID,
+		Networks:      networkIDs,
 		AttachedDisks: []ec.AttachedDisk{
 			ec.AttachedDisk{
 				CapacityGB: 50, // Ignored
@@ -110,17 +189,66 @@ func CreateVM(ctx *cpi.Context, args []interface{}) (result interface{}, err err
 			},
 		},
 	}
-	ctx.Logger.Infof("Creating VM with spec: %#v", spec)
-	vmTask, err := ctx.Client.Projects.CreateVM(ctx.Config.Photon.ProjectID, spec)
+	zoneAffinities := []ec.LocalitySpec{}
+	if cloudProps.AvailabilityZone != "" {
+		zoneID, err := resolveAvailabilityZone(ctx, cloudProps.AvailabilityZone)
+		if err != nil {
+			return nil, err
+		}
+		zoneAffinities = append(zoneAffinities, availabilityZoneAffinity(zoneID))
+		spec.Tags = append(spec.Tags, availabilityZoneTagPrefix+zoneID)
+	}
+	placements, err := resolvePlacements(ctx, cloudProps)
 	if err != nil {
 		return
 	}
-	ctx.Logger.Infof("Waiting on task: %#v", vmTask)
-	vmTask, err = ctx.Client.Tasks.Wait(vmTask.ID)
+	// Place the VM where the persistent disks it gets recreated with can be attached
+	diskAffinities := []ec.LocalitySpec{}
+	for _, diskCID := range diskCIDs {
+		diskAffinities = append(diskAffinities, ec.LocalitySpec{Kind: "disk", ID: diskCID})
+	}
+
+	// Try the placements in order until photon finds a host for one
+	var vmTask *ec.Task
+	var placed placement
+	for i, candidate := range placements {
+		placed = candidate
+		spec.Affinities = append(append(append([]ec.LocalitySpec{}, zoneAffinities...),
+			candidate.affinities...), diskAffinities...)
+		ctx.Logger.Infof("Creating VM with spec: %#v", spec)
+		vmTask, err = ctx.Client.Projects.CreateVM(ctx.Config.Photon.ProjectID, spec)
+		if err == nil {
+			ctx.Logger.Infof("Waiting on task: %#v", vmTask)
+			vmTask, err = waitForTask(ctx, vmTask.ID)
+		}
+		taskErr, ok := err.(ec.TaskError)
+		if !ok || !isAffinityError(taskErr) || i == len(placements)-1 {
+			break
+		}
+		ctx.Logger.Infof("Photon could not place VM on %s, trying the next placement: %s",
+			candidate.description, taskErrorMessages(taskErr))
+	}
+	if taskErr, ok := err.(ec.TaskError); ok && isAffinityError(taskErr) {
+		switch {
+		case len(diskCIDs) > 0:
+			err = cpi.NewBoshError(cpi.VMCreationFailed, false,
+				"Photon could not create VM with affinity to disks %v: %s", diskCIDs, taskErrorMessages(taskErr))
+		case placed.description != "":
+			err = cpi.NewBoshError(cpi.CloudError, false,
+				"Photon could not place VM on %s: %s", placed.description, taskErrorMessages(taskErr))
+		}
+	}
 	if err != nil {
 		return
 	}
 
+	// From here on the VM exists, so don't leave it behind if the remaining steps fail
+	defer func() {
+		if err != nil {
+			err = cleanupFailedVM(ctx, vmTask.Entity.ID, err)
+		}
+	}()
+
 	// Get disk details of VM
 	ctx.Logger.Infof("Getting details of VM: %s", vmTask.Entity.ID)
 	vm, err := ctx.Client.VMs.Get(vmTask.Entity.ID)
@@ -140,6 +268,11 @@ func CreateVM(ctx *cpi.Context, args []interface{}) (result interface{}, err err
 		return
 	}
 
+	err = setNetworkMACs(ctx, vm.ID, nics, networks)
+	if err != nil {
+		return
+	}
+
 	// Create agent config
 	agentEnv := &cpi.AgentEnv{
 		AgentID:  agentID,
@@ -164,6 +297,12 @@ func CreateVM(ctx *cpi.Context, args []interface{}) (result interface{}, err err
 	if err != nil {
 		return
 	}
+	if delivery == cpi.SettingsDeliveryRegistry {
+		err = attachRegistryISO(ctx, vmTask.Entity.ID, agentEnv)
+		if err != nil {
+			return
+		}
+	}
 
 	ctx.Logger.Info("Starting VM")
 	onTask, err := ctx.Client.VMs.Start(vmTask.Entity.ID)
@@ -171,14 +310,124 @@ func CreateVM(ctx *cpi.Context, args []interface{}) (result interface{}, err err
 		return
 	}
 	ctx.Logger.Infof("Waiting on task: %#v", onTask)
-	onTask, err = ctx.Client.Tasks.Wait(onTask.ID)
+	onTask, err = waitForTask(ctx, onTask.ID)
 	if err != nil {
 		return
 	}
 
+	// CPI API v2 also returns the networks the VM was configured with
+	if ctx.ApiVersion >= 2 {
+		return []interface{}{vmTask.Entity.ID, networks}, nil
+	}
 	return vmTask.Entity.ID, nil
 }
 
+// Stops and deletes a VM that create_vm failed to finish, unless configured to keep it.
+// Returns the original error, extended with the outcome of the cleanup if it failed.
+func cleanupFailedVM(ctx *cpi.Context, vmID string, createErr error) error {
+	errorType, canRetry := classifyError(createErr)
+	if ctx.Config.Debug != nil && ctx.Config.Debug.KeepFailedVMs {
+		ctx.Logger.Infof("Keeping VM %s after failed create_vm for debugging", vmID)
+		return cpi.NewBoshError(errorType, canRetry, "%v (VM %s was kept for debugging)", createErr, vmID)
+	}
+
+	ctx.Logger.Errorf("Cleaning up VM %s after failed create_vm: %v", vmID, createErr)
+	err := deleteFailedVM(ctx, vmID)
+	if err != nil {
+		ctx.Logger.Errorf("Failed to clean up VM %s: %v", vmID, err)
+		return cpi.NewBoshError(
+			errorType, canRetry, "%v (cleanup of VM %s also failed: %v)", createErr, vmID, err)
+	}
+	return createErr
+}
+
+func deleteFailedVM(ctx *cpi.Context, vmID string) (err error) {
+	// The VM may not have been started or had an ISO attached yet, so ignore task errors
+	ctx.Logger.Info("Stopping VM")
+	offTask, err := ctx.Client.VMs.Stop(vmID)
+	if err != nil && !isTaskError(err) {
+		return
+	}
+	if err == nil {
+		ctx.Logger.Infof("Waiting on task: %#v", offTask)
+		_, err = waitForTask(ctx, offTask.ID)
+		if err != nil && !isTaskError(err) {
+			return
+		}
+	}
+
+	ctx.Logger.Info("Detaching ISO")
+	detachTask, err := ctx.Client.VMs.DetachISO(vmID)
+	if err != nil && !isTaskError(err) {
+		return
+	}
+	if err == nil {
+		ctx.Logger.Infof("Waiting on task: %#v", detachTask)
+		_, err = waitForTask(ctx, detachTask.ID)
+		if err != nil && !isTaskError(err) {
+			return
+		}
+	}
+
+	ctx.Logger.Info("Deleting VM")
+	task, err := ctx.Client.VMs.Delete(vmID)
+	if err != nil {
+		return
+	}
+	ctx.Logger.Infof("Waiting on task: %#v", task)
+	_, err = waitForTask(ctx, task.ID)
+	return
+}
+
+// Parses the disk_cids argument of create_vm, which the director sends as null when empty
+func parseDiskCIDs(arg interface{}) (diskCIDs []string, err error) {
+	switch arg := arg.(type) {
+	case nil:
+		return []string{}, nil
+	case []string:
+		return arg, nil
+	case []interface{}:
+		for _, diskCID := range arg {
+			diskCID, ok := diskCID.(string)
+			if !ok {
+				return nil, errors.New("Unexpected argument where disk_cids should be")
+			}
+			diskCIDs = append(diskCIDs, diskCID)
+		}
+		return
+	}
+	return nil, errors.New("Unexpected argument where disk_cids should be")
+}
+
+// Error codes photon's scheduler fails with when no host meets the affinities of a VM.
+// Capacity and other task errors aren't caused by the disk affinities.
+var affinityErrorCodes = map[string]bool{
+	"NoSuchResource":               true,
+	"UnfullfillableAffinities":     true,
+	"UnfullfillableDiskAffinities": true,
+}
+
+func isAffinityError(taskErr ec.TaskError) bool {
+	for _, apiErr := range taskErr.Step.Errors {
+		if affinityErrorCodes[apiErr.Code] {
+			return true
+		}
+	}
+	return false
+}
+
+// Joins the errors photon reported on the failed step of a task
+func taskErrorMessages(taskErr ec.TaskError) string {
+	messages := []string{}
+	for _, apiErr := range taskErr.Step.Errors {
+		messages = append(messages, fmt.Sprintf("%s (%s)", apiErr.Message, apiErr.Code))
+	}
+	if len(messages) == 0 {
+		return taskErr.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
 func DeleteVM(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
 	if len(args) < 1 {
 		return nil, errors.New("Expected at least 1 argument")
@@ -190,54 +439,110 @@ func DeleteVM(ctx *cpi.Context, args []interface{}) (result interface{}, err err
 
 	ctx.Logger.Infof("Deleting VM: %s", vmCID)
 
-	ctx.Logger.Info("Detaching disks")
-	// Detach any attached disks first
-	disks, err := ctx.Client.Projects.GetDisks(ctx.Config.Photon.ProjectID, nil)
+	vm, err := ctx.Client.VMs.Get(vmCID)
+	if isNotFoundError(err) {
+		ctx.Logger.Infof("VM '%s' not found, nothing to delete", vmCID)
+		return nil, nil
+	}
 	if err != nil {
 		return
 	}
-	for _, disk := range disks.Items {
-		for _, vmID := range disk.VMs {
-			if vmID == vmCID {
-				ctx.Logger.Infof("Detaching disk: %s", disk.ID)
-				detachOp := &ec.VmDiskOperation{DiskID: disk.ID}
-				detachTask, err := ctx.Client.VMs.DetachDisk(vmCID, detachOp)
-				if err != nil {
-					return nil, err
-				}
-				ctx.Logger.Infof("Waiting on task: %#v", detachTask)
-				detachTask, err = ctx.Client.Tasks.Wait(detachTask.ID)
-				if err != nil {
-					return nil, err
-				}
-			}
+
+	ctx.Logger.Info("Detaching disks")
+	// Detach any attached persistent disks first
+	diskIDs := []string{}
+	for _, disk := range vm.AttachedDisks {
+		if disk.Kind == "persistent-disk" {
+			diskIDs = append(diskIDs, disk.ID)
 		}
 	}
-
-	ctx.Logger.Info("Stopping VM")
-	offTask, err := ctx.Client.VMs.Stop(vmCID)
+	err = detachDisks(ctx, vmCID, diskIDs)
 	if err != nil {
 		return
 	}
-	ctx.Logger.Infof("Waiting on task: %#v", offTask)
-	offTask, err = ctx.Client.Tasks.Wait(offTask.ID)
-	if err != nil {
-		return
+
+	// Photon rejects stopping a VM that isn't running
+	if vm.State == "STOPPED" {
+		ctx.Logger.Info("VM is already stopped")
+	} else {
+		ctx.Logger.Info("Stopping VM")
+		offTask, err := ctx.Client.VMs.Stop(vmCID)
+		if err != nil {
+			return nil, err
+		}
+		ctx.Logger.Infof("Waiting on task: %#v", offTask)
+		offTask, err = waitForTask(ctx, offTask.ID)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	ctx.Logger.Info("Deleting VM")
 	task, err := ctx.Client.VMs.Delete(vmCID)
+	if isNotFoundError(err) {
+		ctx.Logger.Infof("VM '%s' not found, nothing to delete", vmCID)
+		return nil, nil
+	}
 	if err != nil {
 		return
 	}
 	ctx.Logger.Infof("Waiting on task: %#v", task)
-	_, err = ctx.Client.Tasks.Wait(task.ID)
+	_, err = waitForTask(ctx, task.ID)
 	if err != nil {
 		return
 	}
 	return nil, nil
 }
 
+// Detaches disks from a VM in parallel, with at most detachDiskWorkers detaches in flight.
+// All detaches are attempted, and the first failure is returned.
+func detachDisks(ctx *cpi.Context, vmID string, diskIDs []string) error {
+	workers := detachDiskWorkers
+	if len(diskIDs) < workers {
+		workers = len(diskIDs)
+	}
+	diskQueue := make(chan string)
+	errs := make(chan error, len(diskIDs))
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for diskID := range diskQueue {
+				err := detachDisk(ctx, vmID, diskID)
+				if err != nil {
+					ctx.Logger.Errorf("Failed to detach disk %s: %v", diskID, err)
+					errs <- err
+				}
+			}
+		}()
+	}
+	for _, diskID := range diskIDs {
+		diskQueue <- diskID
+	}
+	close(diskQueue)
+	wg.Wait()
+	close(errs)
+
+	// All failures were logged, report the first one
+	if err, ok := <-errs; ok {
+		return err
+	}
+	return nil
+}
+
+func detachDisk(ctx *cpi.Context, vmID string, diskID string) (err error) {
+	ctx.Logger.Infof("Detaching disk: %s", diskID)
+	detachOp := &ec.VmDiskOperation{DiskID: diskID}
+	detachTask, err := ctx.Client.VMs.DetachDisk(vmID, detachOp)
+	if err != nil {
+		return
+	}
+	ctx.Logger.Infof("Waiting on task: %#v", detachTask)
+	_, err = waitForTask(ctx, detachTask.ID)
+	return
+}
+
 func HasVM(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
 	if len(args) < 1 {
 		return nil, errors.New("Expected at least 1 argument")
@@ -249,11 +554,10 @@ func HasVM(ctx *cpi.Context, args []interface{}) (result interface{}, err error)
 
 	ctx.Logger.Infof("Determining if VM exists: %s", vmCID)
 	_, err = ctx.Client.VMs.Get(vmCID)
+	if isNotFoundError(err) {
+		return false, nil
+	}
 	if err != nil {
-		apiErr, ok := err.(ec.ApiError)
-		if ok && apiErr.HttpStatusCode == http.StatusNotFound {
-			return false, nil
-		}
 		return nil, err
 	}
 	return true, nil
@@ -274,7 +578,7 @@ func RestartVM(ctx *cpi.Context, args []interface{}) (result interface{}, err er
 		return
 	}
 	ctx.Logger.Infof("Waiting on task: %#v", task)
-	_, err = ctx.Client.Tasks.Wait(task.ID)
+	_, err = waitForTask(ctx, task.ID)
 	if err != nil {
 		return
 	}
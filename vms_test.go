@@ -10,11 +10,13 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
-	"runtime"
+	"sort"
+	"sync"
 
-	"github.com/vmware/bosh-photon-cpi/cmd"
 	"github.com/vmware/bosh-photon-cpi/cpi"
 	"github.com/vmware/bosh-photon-cpi/logger"
 	. "github.com/vmware/bosh-photon-cpi/mocks"
@@ -32,12 +34,6 @@ var _ = Describe("VMs", func() {
 
 	BeforeEach(func() {
 		server = NewMockServer()
-		var runner cmd.Runner
-		if runtime.GOOS == "linux" {
-			runner = cmd.NewRunner()
-		} else {
-			runner = &fakeRunner{}
-		}
 
 		Activate(true)
 		httpClient := &http.Client{Transport: DefaultMockTransport}
@@ -50,7 +46,6 @@ var _ = Describe("VMs", func() {
 				},
 				Agent: &cpi.AgentConfig{Mbus: "fake-mbus", NTP: []string{"fake-ntp"}},
 			},
-			Runner: runner,
 			Logger: logger.New(),
 		}
 
@@ -99,6 +94,66 @@ var _ = Describe("VMs", func() {
 					Ω(cloudProps.VMAttachedDiskSizeGB).Should(Equal(VMAttachedDiskSizeGBDefault))
 				})
 			})
+
+			Context("when given a cloud prop map containing an `availability_zone` element", func() {
+				It("then it should set the proper value for AvailabilityZone in the response", func() {
+					cloudPropsMap := map[string]interface{}{
+						DiskFlavorElement:       controlDisk,
+						VMFlavorElement:         controlVM,
+						AvailabilityZoneElement: "z1",
+					}
+					cloudProps, err := ParseCloudProps(cloudPropsMap)
+					Ω(err).ShouldNot(HaveOccurred())
+					Ω(cloudProps.AvailabilityZone).Should(Equal("z1"))
+
+					cloudPropsMap[AvailabilityZoneElement] = 1.0
+					_, err = ParseCloudProps(cloudPropsMap)
+					Ω(err).Should(Equal(ErrCloudPropsValues))
+				})
+			})
+
+			Context("when given a cloud prop map containing `hosts` and `datastores` elements", func() {
+				It("then it should set the proper values for Hosts and Datastores in the response", func() {
+					cloudPropsMap := map[string]interface{}{
+						DiskFlavorElement: controlDisk,
+						VMFlavorElement:   controlVM,
+						HostsElement:      []interface{}{"10.0.0.11", "10.0.0.12"},
+						DatastoresElement: []interface{}{"datastore1"},
+					}
+					cloudProps, err := ParseCloudProps(cloudPropsMap)
+					Ω(err).ShouldNot(HaveOccurred())
+					Ω(cloudProps.Hosts).Should(Equal([]string{"10.0.0.11", "10.0.0.12"}))
+					Ω(cloudProps.Datastores).Should(Equal([]string{"datastore1"}))
+
+					cloudPropsMap[DatastoresElement] = "datastore1"
+					_, err = ParseCloudProps(cloudPropsMap)
+					Ω(err).Should(Equal(ErrCloudPropsValues))
+				})
+			})
+
+			Context("when given a cloud prop map containing `host` and `datastore` elements", func() {
+				It("then it should set the proper values for Host and Datastore in the response", func() {
+					cloudPropsMap := map[string]interface{}{
+						DiskFlavorElement: controlDisk,
+						VMFlavorElement:   controlVM,
+						HostElement:       "10.0.0.11",
+						DatastoreElement:  "datastore1",
+					}
+					cloudProps, err := ParseCloudProps(cloudPropsMap)
+					Ω(err).ShouldNot(HaveOccurred())
+					Ω(cloudProps.Host).Should(Equal("10.0.0.11"))
+					Ω(cloudProps.Datastore).Should(Equal("datastore1"))
+
+					cloudPropsMap[HostElement] = ""
+					_, err = ParseCloudProps(cloudPropsMap)
+					Ω(err).Should(Equal(ErrCloudPropsValues))
+
+					cloudPropsMap[HostElement] = "10.0.0.11"
+					cloudPropsMap[HostsElement] = []interface{}{"10.0.0.12"}
+					_, err = ParseCloudProps(cloudPropsMap)
+					Ω(err).Should(Equal(ErrCloudPropsValues))
+				})
+			})
 		})
 	})
 
@@ -190,22 +245,75 @@ var _ = Describe("VMs", func() {
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(res.Log).ShouldNot(BeEmpty())
 		})
-		It("should return an error when server returns error", func() {
+		It("should return ID and networks of created VM under API v2", func() {
 			createTask := &ec.Task{Operation: "CREATE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
 			completedTask := &ec.Task{Operation: "CREATE_VM", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
 
+			isoTask := &ec.Task{Operation: "ATTACH_ISO", State: "QUEUED", ID: "fake-iso-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			isoCompletedTask := &ec.Task{Operation: "ATTACH_ISO", State: "COMPLETED", ID: "fake-iso-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+
+			onTask := &ec.Task{Operation: "START_VM", State: "QUEUED", ID: "fake-on-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			onCompletedTask := &ec.Task{Operation: "START_VM", State: "COMPLETED", ID: "fake-on-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+
+			detachTask := &ec.Task{Operation: "DETACH_ISO", State: "ERROR", ID: "fake-detach-id"}
+
+			vm := &ec.VM{
+				ID: createTask.Entity.ID,
+				AttachedDisks: []ec.AttachedDisk{
+					ec.AttachedDisk{Name: "bosh-ephemeral-disk", ID: "fake-eph-disk-id"},
+				},
+			}
+			metadataTask := &ec.Task{State: "COMPLETED"}
+
 			RegisterResponder(
 				"POST",
 				server.URL+"/projects/"+projID+"/vms",
-				CreateResponder(500, ToJson(createTask)))
+				CreateResponder(200, ToJson(createTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+"/vms/"+createTask.Entity.ID,
+				CreateResponder(200, ToJson(vm)))
 			RegisterResponder(
 				"GET",
 				server.URL+"/tasks/"+createTask.ID,
 				CreateResponder(200, ToJson(completedTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+"/vms/"+createTask.Entity.ID+"/attach_iso",
+				CreateResponder(200, ToJson(isoTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+"/vms/"+createTask.Entity.ID+"/detach_iso",
+				CreateResponder(200, ToJson(detachTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+"/vms/"+createTask.Entity.ID+"/start",
+				CreateResponder(200, ToJson(onTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+"/vms/fake-vm-id/set_metadata",
+				CreateResponder(200, ToJson(metadataTask)))
+
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+isoTask.ID,
+				CreateResponder(200, ToJson(isoCompletedTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+onCompletedTask.ID,
+				CreateResponder(200, ToJson(onCompletedTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+detachTask.ID,
+				CreateResponder(200, ToJson(detachTask)))
 
+			ctx.ApiVersion = 2
 			actions := map[string]cpi.ActionFn{
 				"create_vm": CreateVM,
 			}
+			networks := map[string]interface{}{
+				"default": map[string]interface{}{"type": "dynamic"},
+			}
 			args := []interface{}{
 				"agent-id",
 				"fake-stemcell-id",
@@ -213,18 +321,19 @@ var _ = Describe("VMs", func() {
 					"vm_flavor":   "fake-flavor",
 					"disk_flavor": "fake-flavor",
 				}, // cloud_properties
-				map[string]interface{}{}, // networks
+				networks,                 // networks
 				[]string{},               // disk_cids
 				map[string]interface{}{}, // environment
 			}
 			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
 
-			Expect(res.Result).Should(BeNil())
-			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Result).Should(Equal([]interface{}{completedTask.Entity.ID, networks}))
+			Expect(res.Error).Should(BeNil())
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(res.Log).ShouldNot(BeEmpty())
 		})
-		It("should return an error when cloud_properties has bad property type", func() {
+		It("should reject metadata settings delivery", func() {
+			ctx.Config.Agent.SettingsDelivery = "metadata"
 			actions := map[string]cpi.ActionFn{
 				"create_vm": CreateVM,
 			}
@@ -232,7 +341,7 @@ var _ = Describe("VMs", func() {
 				"agent-id",
 				"fake-stemcell-id",
 				map[string]interface{}{
-					"vm_flavor":   123,
+					"vm_flavor":   "fake-flavor",
 					"disk_flavor": "fake-flavor",
 				}, // cloud_properties
 				map[string]interface{}{}, // networks
@@ -241,103 +350,1062 @@ var _ = Describe("VMs", func() {
 			}
 			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
 
-			Expect(res.Result).Should(BeNil())
-			Expect(res.Error).ShouldNot(BeNil())
 			Expect(err).ShouldNot(HaveOccurred())
-			Expect(res.Log).ShouldNot(BeEmpty())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.CpiError))
+			Expect(res.Error.Message).Should(ContainSubstring("Unknown agent settings_delivery 'metadata'"))
 		})
-		It("should return an error when cloud_properties has no properties", func() {
+		It("should return an error for an unknown settings delivery", func() {
+			ctx.Config.Agent.SettingsDelivery = "floppy"
 			actions := map[string]cpi.ActionFn{
 				"create_vm": CreateVM,
 			}
-			args := []interface{}{"agent-id", "fake-stemcell-id", map[string]interface{}{}}
+			args := []interface{}{
+				"agent-id",
+				"fake-stemcell-id",
+				map[string]interface{}{
+					"vm_flavor":   "fake-flavor",
+					"disk_flavor": "fake-flavor",
+				}, // cloud_properties
+				map[string]interface{}{}, // networks
+				[]string{},               // disk_cids
+				map[string]interface{}{}, // environment
+			}
 			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
 
-			Expect(res.Result).Should(BeNil())
-			Expect(res.Error).ShouldNot(BeNil())
 			Expect(err).ShouldNot(HaveOccurred())
-			Expect(res.Log).ShouldNot(BeEmpty())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.CpiError))
+			Expect(res.Error.Message).Should(ContainSubstring("Unknown agent settings_delivery 'floppy'"))
 		})
-		It("should return an error when cloud_properties is missing", func() {
+		It("should return an error naming the field of an invalid network before creating the VM", func() {
 			actions := map[string]cpi.ActionFn{
 				"create_vm": CreateVM,
 			}
-			args := []interface{}{"agent-id", "fake-stemcell-id"}
+			args := []interface{}{
+				"agent-id",
+				"fake-stemcell-id",
+				map[string]interface{}{
+					"vm_flavor":   "fake-flavor",
+					"disk_flavor": "fake-flavor",
+				}, // cloud_properties
+				map[string]interface{}{
+					"default": map[string]interface{}{
+						"type":    "manual",
+						"ip":      "10.0.0.5",
+						"netmask": "255.255.255.0",
+						"gateway": "10.0.1.1",
+						"default": []interface{}{"dns", "gateway"},
+					},
+				}, // networks
+				[]string{},               // disk_cids
+				map[string]interface{}{}, // environment
+			}
 			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
 
-			Expect(res.Result).Should(BeNil())
-			Expect(res.Error).ShouldNot(BeNil())
 			Expect(err).ShouldNot(HaveOccurred())
-			Expect(res.Log).ShouldNot(BeEmpty())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.CpiError))
+			Expect(res.Error.Message).Should(ContainSubstring("networks.default.gateway '10.0.1.1'"))
 		})
-	})
+		It("should create the VM with affinity to the given disks", func() {
+			createTask := &ec.Task{Operation: "CREATE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			failedTask := &ec.Task{
+				Operation: "CREATE_VM",
+				State:     "ERROR",
+				ID:        "fake-task-id",
+				Entity:    ec.Entity{ID: "fake-vm-id"},
+				Steps: []ec.Step{
+					ec.Step{
+						State: "ERROR",
+						Errors: []ec.ApiError{
+							ec.ApiError{Code: "NoSuchResource", Message: "No host can reach datastore of disk fake-disk-1"},
+						},
+					},
+				},
+			}
 
-	Describe("DeleteVM", func() {
-		It("should return nothing when successful", func() {
-			deleteTask := &ec.Task{Operation: "DELETE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
-			completedTask := &ec.Task{Operation: "DELETE_VM", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			var spec *ec.VmCreateSpec
+			RegisterResponder(
+				"POST",
+				server.URL+"/projects/"+projID+"/vms",
+				func(req *http.Request) (*http.Response, error) {
+					spec = &ec.VmCreateSpec{}
+					Expect(json.NewDecoder(req.Body).Decode(spec)).Should(Succeed())
+					return CreateResponder(200, ToJson(createTask))(req)
+				})
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+createTask.ID,
+				CreateResponder(200, ToJson(failedTask)))
 
-			offTask := &ec.Task{Operation: "STOP_VM", State: "QUEUED", ID: "fake-off-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
-			offCompletedTask := &ec.Task{Operation: "STOP_VM", State: "COMPLETED", ID: "fake-off-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			actions := map[string]cpi.ActionFn{
+				"create_vm": CreateVM,
+			}
+			args := []interface{}{
+				"agent-id",
+				"fake-stemcell-id",
+				map[string]interface{}{
+					"vm_flavor":   "fake-flavor",
+					"disk_flavor": "fake-flavor",
+				}, // cloud_properties
+				map[string]interface{}{},                    // networks
+				[]interface{}{"fake-disk-1", "fake-disk-2"}, // disk_cids
+				map[string]interface{}{},                    // environment
+			}
+			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
 
-			disks := &ec.DiskList{[]ec.PersistentDisk{
-				ec.PersistentDisk{ID: "fake-disk-1", VMs: []string{completedTask.Entity.ID}},
-			}}
-			detachQueuedTask := &ec.Task{Operation: "DETACH_DISK", State: "QUEUED", ID: "fake-disk-task-1", Entity: ec.Entity{ID: "fake-disk-1"}}
-			detachCompletedTask := &ec.Task{Operation: "DETACH_DISK", State: "COMPLETED", ID: "fake-disk-task-1", Entity: ec.Entity{ID: "fake-disk-1"}}
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(spec.Affinities).Should(Equal([]ec.LocalitySpec{
+				ec.LocalitySpec{Kind: "disk", ID: "fake-disk-1"},
+				ec.LocalitySpec{Kind: "disk", ID: "fake-disk-2"},
+			}))
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.VMCreationFailed))
+			Expect(res.Error.CanRetry).Should(BeFalse())
+			Expect(res.Error.Message).Should(ContainSubstring("affinity to disks [fake-disk-1 fake-disk-2]"))
+			Expect(res.Error.Message).Should(ContainSubstring("No host can reach datastore of disk fake-disk-1 (NoSuchResource)"))
+		})
+		It("should not blame the disk affinities for unrelated task errors", func() {
+			createTask := &ec.Task{Operation: "CREATE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			failedTask := &ec.Task{
+				Operation: "CREATE_VM",
+				State:     "ERROR",
+				ID:        "fake-task-id",
+				Entity:    ec.Entity{ID: "fake-vm-id"},
+				Steps: []ec.Step{
+					ec.Step{
+						State: "ERROR",
+						Errors: []ec.ApiError{
+							ec.ApiError{Code: "QuotaError", Message: "Not enough quota for vm.count"},
+						},
+					},
+				},
+			}
 
-			RegisterResponder(
-				"DELETE",
-				server.URL+"/vms/"+deleteTask.Entity.ID,
-				CreateResponder(200, ToJson(deleteTask)))
-			RegisterResponder(
-				"POST",
-				server.URL+"/vms/"+deleteTask.Entity.ID+"/stop",
-				CreateResponder(200, ToJson(offTask)))
 			RegisterResponder(
 				"POST",
-				server.URL+"/vms/"+deleteTask.Entity.ID+"/detach_disk",
-				CreateResponder(200, ToJson(detachQueuedTask)))
+				server.URL+"/projects/"+projID+"/vms",
+				CreateResponder(200, ToJson(createTask)))
 			RegisterResponder(
 				"GET",
-				server.URL+"/tasks/"+detachCompletedTask.ID,
-				CreateResponder(200, ToJson(detachCompletedTask)))
+				server.URL+"/tasks/"+createTask.ID,
+				CreateResponder(200, ToJson(failedTask)))
+
+			actions := map[string]cpi.ActionFn{
+				"create_vm": CreateVM,
+			}
+			args := []interface{}{
+				"agent-id",
+				"fake-stemcell-id",
+				map[string]interface{}{
+					"vm_flavor":   "fake-flavor",
+					"disk_flavor": "fake-flavor",
+				}, // cloud_properties
+				map[string]interface{}{},     // networks
+				[]interface{}{"fake-disk-1"}, // disk_cids
+				map[string]interface{}{},     // environment
+			}
+			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.CloudError))
+			Expect(res.Error.Message).ShouldNot(ContainSubstring("affinity to disks"))
+
+			// Running out of capacity isn't the fault of the disk affinities either
+			failedTask.Steps[0].Errors[0] = ec.ApiError{Code: "NotEnoughMemoryResource", Message: "Not enough memory"}
 			RegisterResponder(
 				"GET",
-				server.URL+"/tasks/"+deleteTask.ID,
-				CreateResponder(200, ToJson(completedTask)))
+				server.URL+"/tasks/"+createTask.ID,
+				CreateResponder(200, ToJson(failedTask)))
+			res, err = GetResponse(dispatch(ctx, actions, "create_vm", args))
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.CloudError))
+			Expect(res.Error.Message).ShouldNot(ContainSubstring("affinity to disks"))
+		})
+		It("should place the VM in the availability zone of its cloud_properties", func() {
+			zones := &ec.AvailabilityZones{Items: []ec.AvailabilityZone{
+				ec.AvailabilityZone{ID: "fake-az-1-id", Name: "z1"},
+				ec.AvailabilityZone{ID: "fake-az-2-id", Name: "z2"},
+			}}
 			RegisterResponder(
 				"GET",
-				server.URL+"/tasks/"+offCompletedTask.ID,
-				CreateResponder(200, ToJson(offCompletedTask)))
+				server.URL+"/availabilityzones",
+				CreateResponder(200, ToJson(zones)))
+			var spec *ec.VmCreateSpec
 			RegisterResponder(
-				"GET",
-				server.URL+"/projects/"+projID+"/disks",
-				CreateResponder(200, ToJson(disks)))
+				"POST",
+				server.URL+"/projects/"+projID+"/vms",
+				func(req *http.Request) (*http.Response, error) {
+					spec = &ec.VmCreateSpec{}
+					Expect(json.NewDecoder(req.Body).Decode(spec)).Should(Succeed())
+					return CreateResponder(500, ToJson(ec.ApiError{Code: "InternalError"}))(req)
+				})
 
 			actions := map[string]cpi.ActionFn{
-				"delete_vm": DeleteVM,
+				"create_vm": CreateVM,
 			}
-			args := []interface{}{"fake-vm-id"}
-			res, err := GetResponse(dispatch(ctx, actions, "delete_vm", args))
+			args := []interface{}{
+				"agent-id",
+				"fake-stemcell-id",
+				map[string]interface{}{
+					"vm_flavor":         "fake-flavor",
+					"disk_flavor":       "fake-flavor",
+					"availability_zone": "z2",
+				}, // cloud_properties
+				map[string]interface{}{}, // networks
+				[]string{},               // disk_cids
+				map[string]interface{}{}, // environment
+			}
+			_, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(spec.Affinities).Should(Equal([]ec.LocalitySpec{ec.LocalitySpec{Kind: "availabilityZone", ID: "fake-az-2-id"}}))
+			Expect(spec.Tags).Should(Equal([]string{"bosh-availability-zone:fake-az-2-id"}))
 
-			Expect(res.Result).Should(BeNil())
-			Expect(res.Error).Should(BeNil())
+			args[2].(map[string]interface{})["availability_zone"] = "fake-az-1-id"
+			_, err = GetResponse(dispatch(ctx, actions, "create_vm", args))
 			Expect(err).ShouldNot(HaveOccurred())
-			Expect(res.Log).ShouldNot(BeEmpty())
-		})
-		It("should return an error when VM not found", func() {
-			deleteTask := &ec.Task{Operation: "DELETE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
-			completedTask := &ec.Task{Operation: "DELETE_VM", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			Expect(spec.Affinities).Should(Equal([]ec.LocalitySpec{ec.LocalitySpec{Kind: "availabilityZone", ID: "fake-az-1-id"}}))
 
-			RegisterResponder(
-				"DELETE",
-				server.URL+"/vms/"+deleteTask.Entity.ID,
-				CreateResponder(404, ToJson(deleteTask)))
+			args[2].(map[string]interface{})["availability_zone"] = "z3"
+			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Message).Should(ContainSubstring("Availability zone 'z3' not found"))
+		})
+		It("should pin the VM to the host and datastore of its cloud_properties", func() {
+			hosts := &ec.Hosts{Items: []ec.Host{
+				ec.Host{ID: "fake-host-1-id", Address: "10.0.0.11", State: "READY"},
+				ec.Host{ID: "fake-host-2-id", Address: "10.0.0.12", State: "MAINTENANCE"},
+			}}
 			RegisterResponder(
 				"GET",
-				server.URL+"/tasks/"+deleteTask.ID,
-				CreateResponder(200, ToJson(completedTask)))
+				server.URL+"/hosts",
+				CreateResponder(200, ToJson(hosts)))
+			var spec *ec.VmCreateSpec
+			RegisterResponder(
+				"POST",
+				server.URL+"/projects/"+projID+"/vms",
+				func(req *http.Request) (*http.Response, error) {
+					spec = &ec.VmCreateSpec{}
+					Expect(json.NewDecoder(req.Body).Decode(spec)).Should(Succeed())
+					return CreateResponder(500, ToJson(ec.ApiError{Code: "InternalError"}))(req)
+				})
+
+			actions := map[string]cpi.ActionFn{
+				"create_vm": CreateVM,
+			}
+			cloudProps := map[string]interface{}{
+				"vm_flavor":   "fake-flavor",
+				"disk_flavor": "fake-flavor",
+				"host":        "10.0.0.11",
+				"datastore":   "fake-local-ssd",
+			}
+			args := []interface{}{
+				"agent-id",
+				"fake-stemcell-id",
+				cloudProps,               // cloud_properties
+				map[string]interface{}{}, // networks
+				[]string{},               // disk_cids
+				map[string]interface{}{}, // environment
+			}
+			_, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(spec.Affinities).Should(Equal([]ec.LocalitySpec{
+				ec.LocalitySpec{Kind: "host", ID: "fake-host-1-id"},
+				ec.LocalitySpec{Kind: "datastore", ID: "fake-local-ssd"},
+			}))
+
+			cloudProps["host"] = "10.0.0.21"
+			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.CloudError))
+			Expect(res.Error.Message).Should(ContainSubstring("Host '10.0.0.21' not found"))
+
+			cloudProps["host"] = "10.0.0.12"
+			res, err = GetResponse(dispatch(ctx, actions, "create_vm", args))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Message).Should(ContainSubstring("Host '10.0.0.12' is in state 'MAINTENANCE'"))
+		})
+		It("should name the datastore when photon can't place the VM on it", func() {
+			createTask := &ec.Task{Operation: "CREATE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			failedTask := &ec.Task{
+				Operation: "CREATE_VM",
+				State:     "ERROR",
+				ID:        "fake-task-id",
+				Entity:    ec.Entity{ID: "fake-vm-id"},
+				Steps: []ec.Step{
+					ec.Step{
+						State: "ERROR",
+						Errors: []ec.ApiError{
+							ec.ApiError{Code: "NoSuchResource", Message: "No such datastore"},
+						},
+					},
+				},
+			}
+			RegisterResponder(
+				"POST",
+				server.URL+"/projects/"+projID+"/vms",
+				CreateResponder(200, ToJson(createTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+createTask.ID,
+				CreateResponder(200, ToJson(failedTask)))
+
+			actions := map[string]cpi.ActionFn{
+				"create_vm": CreateVM,
+			}
+			args := []interface{}{
+				"agent-id",
+				"fake-stemcell-id",
+				map[string]interface{}{
+					"vm_flavor":   "fake-flavor",
+					"disk_flavor": "fake-flavor",
+					"datastore":   "fake-local-ssd",
+				}, // cloud_properties
+				map[string]interface{}{}, // networks
+				[]string{},               // disk_cids
+				map[string]interface{}{}, // environment
+			}
+			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.CloudError))
+			Expect(res.Error.Message).Should(ContainSubstring(
+				"Photon could not place VM on datastore 'fake-local-ssd': No such datastore (NoSuchResource)"))
+		})
+		It("should try the preferred hosts and datastores in turn", func() {
+			hosts := &ec.Hosts{Items: []ec.Host{
+				ec.Host{ID: "fake-host-1-id", Address: "10.0.0.11", State: "READY"},
+				ec.Host{ID: "fake-host-2-id", Address: "10.0.0.12", State: "MAINTENANCE"},
+				ec.Host{ID: "fake-host-3-id", Address: "10.0.0.13", State: "READY"},
+			}}
+			createTask := &ec.Task{Operation: "CREATE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			failedTask := &ec.Task{
+				Operation: "CREATE_VM",
+				State:     "ERROR",
+				ID:        "fake-task-id",
+				Entity:    ec.Entity{ID: "fake-vm-id"},
+				Steps: []ec.Step{
+					ec.Step{
+						State: "ERROR",
+						Errors: []ec.ApiError{
+							ec.ApiError{Code: "NoSuchResource", Message: "No host matches the affinities"},
+						},
+					},
+				},
+			}
+			RegisterResponder(
+				"GET",
+				server.URL+"/hosts",
+				CreateResponder(200, ToJson(hosts)))
+			affinities := [][]ec.LocalitySpec{}
+			RegisterResponder(
+				"POST",
+				server.URL+"/projects/"+projID+"/vms",
+				func(req *http.Request) (*http.Response, error) {
+					spec := &ec.VmCreateSpec{}
+					Expect(json.NewDecoder(req.Body).Decode(spec)).Should(Succeed())
+					affinities = append(affinities, spec.Affinities)
+					return CreateResponder(200, ToJson(createTask))(req)
+				})
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+createTask.ID,
+				CreateResponder(200, ToJson(failedTask)))
+
+			actions := map[string]cpi.ActionFn{
+				"create_vm": CreateVM,
+			}
+			args := []interface{}{
+				"agent-id",
+				"fake-stemcell-id",
+				map[string]interface{}{
+					"vm_flavor":   "fake-flavor",
+					"disk_flavor": "fake-flavor",
+					"hosts":       []interface{}{"10.0.0.11", "10.0.0.12", "fake-host-3-id"},
+					"datastores":  []interface{}{"fake-local-ssd"},
+				}, // cloud_properties
+				map[string]interface{}{}, // networks
+				[]string{},               // disk_cids
+				map[string]interface{}{}, // environment
+			}
+			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.CloudError))
+			Expect(res.Error.Message).ShouldNot(ContainSubstring("could not place VM on"))
+			host1 := ec.LocalitySpec{Kind: "host", ID: "fake-host-1-id"}
+			host3 := ec.LocalitySpec{Kind: "host", ID: "fake-host-3-id"}
+			datastore := ec.LocalitySpec{Kind: "datastore", ID: "fake-local-ssd"}
+			Expect(affinities).Should(Equal([][]ec.LocalitySpec{
+				[]ec.LocalitySpec{host1, datastore},
+				[]ec.LocalitySpec{host1},
+				[]ec.LocalitySpec{host3, datastore},
+				[]ec.LocalitySpec{host3},
+				[]ec.LocalitySpec{datastore},
+				nil,
+			}))
+		})
+		It("should create NICs on the photon networks of the BOSH networks", func() {
+			photonNetworks := &ec.Networks{Items: []ec.Network{
+				ec.Network{ID: "fake-network-1-id", Name: "cloud-network-1"},
+				ec.Network{ID: "fake-network-2-id", Name: "cloud-network-2"},
+				ec.Network{ID: "fake-network-3-id", Name: "cloud-network-3"},
+			}}
+			RegisterResponder(
+				"GET",
+				server.URL+"/networks",
+				CreateResponder(200, ToJson(photonNetworks)))
+			var spec *ec.VmCreateSpec
+			RegisterResponder(
+				"POST",
+				server.URL+"/projects/"+projID+"/vms",
+				func(req *http.Request) (*http.Response, error) {
+					spec = &ec.VmCreateSpec{}
+					Expect(json.NewDecoder(req.Body).Decode(spec)).Should(Succeed())
+					return CreateResponder(500, ToJson(ec.ApiError{Code: "InternalError"}))(req)
+				})
+
+			actions := map[string]cpi.ActionFn{
+				"create_vm": CreateVM,
+			}
+			networks := map[string]interface{}{
+				"a-private": map[string]interface{}{
+					"type":             "dynamic",
+					"cloud_properties": map[string]interface{}{"name": "cloud-network-2"},
+				},
+				"b-private": map[string]interface{}{
+					"type":             "dynamic",
+					"cloud_properties": map[string]interface{}{"name": "fake-network-3-id"},
+				},
+				"public": map[string]interface{}{
+					"type":             "dynamic",
+					"default":          []interface{}{"dns", "gateway"},
+					"cloud_properties": map[string]interface{}{"name": "cloud-network-1"},
+				},
+				"floating": map[string]interface{}{
+					"type": "vip",
+					"ip":   "192.168.0.10",
+				},
+			}
+			args := []interface{}{
+				"agent-id",
+				"fake-stemcell-id",
+				map[string]interface{}{
+					"vm_flavor":   "fake-flavor",
+					"disk_flavor": "fake-flavor",
+				}, // cloud_properties
+				networks,                 // networks
+				[]string{},               // disk_cids
+				map[string]interface{}{}, // environment
+			}
+			_, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(spec.Networks).Should(Equal([]string{"fake-network-1-id", "fake-network-2-id", "fake-network-3-id"}))
+
+			spec = nil
+			networks["b-private"].(map[string]interface{})["cloud_properties"] = map[string]interface{}{"name": "cloud-network-4"}
+			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(spec).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.CloudError))
+			Expect(res.Error.Message).Should(ContainSubstring("BOSH network 'b-private': photon network 'cloud-network-4' not found"))
+		})
+		It("should reject mixing named and unnamed networks", func() {
+			actions := map[string]cpi.ActionFn{
+				"create_vm": CreateVM,
+			}
+			networks := map[string]interface{}{
+				"public": map[string]interface{}{
+					"type":             "dynamic",
+					"default":          []interface{}{"dns", "gateway"},
+					"cloud_properties": map[string]interface{}{"name": "cloud-network-1"},
+				},
+				"private": map[string]interface{}{
+					"type": "dynamic",
+				},
+				"floating": map[string]interface{}{
+					"type": "vip",
+					"ip":   "192.168.0.10",
+				},
+			}
+			args := []interface{}{
+				"agent-id",
+				"fake-stemcell-id",
+				map[string]interface{}{
+					"vm_flavor":   "fake-flavor",
+					"disk_flavor": "fake-flavor",
+				}, // cloud_properties
+				networks,                 // networks
+				[]string{},               // disk_cids
+				map[string]interface{}{}, // environment
+			}
+			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.CpiError))
+			Expect(res.Error.Message).Should(ContainSubstring("BOSH networks [private] have no cloud_properties.name"))
+		})
+		It("should give each BOSH network the MAC of its NIC", func() {
+			createTask := &ec.Task{Operation: "CREATE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			completedTask := &ec.Task{Operation: "CREATE_VM", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+
+			networksTask := &ec.Task{Operation: "GET_NETWORKS", State: "QUEUED", ID: "fake-networks-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			networksCompletedTask := &ec.Task{
+				Operation: "GET_NETWORKS",
+				State:     "COMPLETED",
+				ID:        "fake-networks-task-id",
+				Entity:    ec.Entity{ID: "fake-vm-id"},
+				ResourceProperties: map[string]interface{}{
+					"networkConnections": []interface{}{
+						map[string]interface{}{"network": "fake-network-2-id", "macAddress": "00:50:56:00:00:02"},
+						map[string]interface{}{"network": "fake-port-group-1", "macAddress": "00:50:56:00:00:01"},
+					},
+				},
+			}
+
+			isoTask := &ec.Task{Operation: "ATTACH_ISO", State: "QUEUED", ID: "fake-iso-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			isoCompletedTask := &ec.Task{Operation: "ATTACH_ISO", State: "COMPLETED", ID: "fake-iso-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+
+			onTask := &ec.Task{Operation: "START_VM", State: "QUEUED", ID: "fake-on-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			onCompletedTask := &ec.Task{Operation: "START_VM", State: "COMPLETED", ID: "fake-on-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+
+			detachTask := &ec.Task{Operation: "DETACH_ISO", State: "ERROR", ID: "fake-detach-id"}
+
+			vm := &ec.VM{
+				ID: createTask.Entity.ID,
+				AttachedDisks: []ec.AttachedDisk{
+					ec.AttachedDisk{Name: "bosh-ephemeral-disk", ID: "fake-eph-disk-id"},
+				},
+			}
+			photonNetworks := &ec.Networks{Items: []ec.Network{
+				ec.Network{ID: "fake-network-1-id", Name: "cloud-network-1", PortGroups: []string{"fake-port-group-1"}},
+				ec.Network{ID: "fake-network-2-id", Name: "cloud-network-2"},
+			}}
+			metadataTask := &ec.Task{State: "COMPLETED"}
+
+			RegisterResponder(
+				"GET",
+				server.URL+"/networks",
+				CreateResponder(200, ToJson(photonNetworks)))
+			RegisterResponder(
+				"POST",
+				server.URL+"/projects/"+projID+"/vms",
+				CreateResponder(200, ToJson(createTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+"/vms/"+createTask.Entity.ID,
+				CreateResponder(200, ToJson(vm)))
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+createTask.ID,
+				CreateResponder(200, ToJson(completedTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+"/vms/"+createTask.Entity.ID+"/networks",
+				CreateResponder(200, ToJson(networksTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+networksTask.ID,
+				CreateResponder(200, ToJson(networksCompletedTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+"/vms/"+createTask.Entity.ID+"/attach_iso",
+				CreateResponder(200, ToJson(isoTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+"/vms/"+createTask.Entity.ID+"/detach_iso",
+				CreateResponder(200, ToJson(detachTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+"/vms/"+createTask.Entity.ID+"/start",
+				CreateResponder(200, ToJson(onTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+"/vms/fake-vm-id/set_metadata",
+				CreateResponder(200, ToJson(metadataTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+isoTask.ID,
+				CreateResponder(200, ToJson(isoCompletedTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+onCompletedTask.ID,
+				CreateResponder(200, ToJson(onCompletedTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+detachTask.ID,
+				CreateResponder(200, ToJson(detachTask)))
+
+			ctx.ApiVersion = 2
+			actions := map[string]cpi.ActionFn{
+				"create_vm": CreateVM,
+			}
+			networks := map[string]interface{}{
+				"public": map[string]interface{}{
+					"type":             "dynamic",
+					"default":          []interface{}{"dns", "gateway"},
+					"cloud_properties": map[string]interface{}{"name": "cloud-network-1"},
+				},
+				"private": map[string]interface{}{
+					"type":             "dynamic",
+					"cloud_properties": map[string]interface{}{"name": "cloud-network-2"},
+				},
+			}
+			args := []interface{}{
+				"agent-id",
+				"fake-stemcell-id",
+				map[string]interface{}{
+					"vm_flavor":   "fake-flavor",
+					"disk_flavor": "fake-flavor",
+				}, // cloud_properties
+				networks,                 // networks
+				[]string{},               // disk_cids
+				map[string]interface{}{}, // environment
+			}
+			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Error).Should(BeNil())
+			result := res.Result.([]interface{})
+			Expect(result[1]).Should(HaveKeyWithValue("public", HaveKeyWithValue("mac", "00:50:56:00:00:01")))
+			Expect(result[1]).Should(HaveKeyWithValue("private", HaveKeyWithValue("mac", "00:50:56:00:00:02")))
+		})
+		It("should return an error when disk_cids has an unexpected type", func() {
+			actions := map[string]cpi.ActionFn{
+				"create_vm": CreateVM,
+			}
+			args := []interface{}{
+				"agent-id",
+				"fake-stemcell-id",
+				map[string]interface{}{
+					"vm_flavor":   "fake-flavor",
+					"disk_flavor": "fake-flavor",
+				}, // cloud_properties
+				map[string]interface{}{}, // networks
+				[]interface{}{5},         // disk_cids
+				map[string]interface{}{}, // environment
+			}
+			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Message).Should(ContainSubstring("disk_cids"))
+		})
+		It("should return an error when server returns error", func() {
+			createTask := &ec.Task{Operation: "CREATE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			completedTask := &ec.Task{Operation: "CREATE_VM", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+
+			RegisterResponder(
+				"POST",
+				server.URL+"/projects/"+projID+"/vms",
+				CreateResponder(500, ToJson(createTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+createTask.ID,
+				CreateResponder(200, ToJson(completedTask)))
+
+			actions := map[string]cpi.ActionFn{
+				"create_vm": CreateVM,
+			}
+			args := []interface{}{
+				"agent-id",
+				"fake-stemcell-id",
+				map[string]interface{}{
+					"vm_flavor":   "fake-flavor",
+					"disk_flavor": "fake-flavor",
+				}, // cloud_properties
+				map[string]interface{}{}, // networks
+				[]string{},               // disk_cids
+				map[string]interface{}{}, // environment
+			}
+			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		Context("when a step after creating the VM fails", func() {
+			var (
+				args    []interface{}
+				actions map[string]cpi.ActionFn
+				deleted bool
+			)
+
+			BeforeEach(func() {
+				createTask := &ec.Task{Operation: "CREATE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+				completedTask := &ec.Task{Operation: "CREATE_VM", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+				// The VM was never started and has no ISO attached
+				stopTask := &ec.Task{Operation: "STOP_VM", State: "ERROR", ID: "fake-stop-task-id"}
+				detachTask := &ec.Task{Operation: "DETACH_ISO", State: "ERROR", ID: "fake-detach-id"}
+				deleteTask := &ec.Task{Operation: "DELETE_VM", State: "QUEUED", ID: "fake-delete-task-id"}
+				deleteCompletedTask := &ec.Task{Operation: "DELETE_VM", State: "COMPLETED", ID: "fake-delete-task-id"}
+
+				// Missing ephemeral disk makes create_vm fail
+				vm := &ec.VM{ID: createTask.Entity.ID}
+				deleted = false
+
+				RegisterResponder(
+					"POST",
+					server.URL+"/projects/"+projID+"/vms",
+					CreateResponder(200, ToJson(createTask)))
+				RegisterResponder(
+					"GET",
+					server.URL+"/tasks/"+createTask.ID,
+					CreateResponder(200, ToJson(completedTask)))
+				RegisterResponder(
+					"GET",
+					server.URL+"/vms/"+createTask.Entity.ID,
+					CreateResponder(200, ToJson(vm)))
+				RegisterResponder(
+					"POST",
+					server.URL+"/vms/"+createTask.Entity.ID+"/stop",
+					CreateResponder(200, ToJson(stopTask)))
+				RegisterResponder(
+					"GET",
+					server.URL+"/tasks/"+stopTask.ID,
+					CreateResponder(200, ToJson(stopTask)))
+				RegisterResponder(
+					"POST",
+					server.URL+"/vms/"+createTask.Entity.ID+"/detach_iso",
+					CreateResponder(200, ToJson(detachTask)))
+				RegisterResponder(
+					"GET",
+					server.URL+"/tasks/"+detachTask.ID,
+					CreateResponder(200, ToJson(detachTask)))
+				RegisterResponder(
+					"DELETE",
+					server.URL+"/vms/"+createTask.Entity.ID,
+					func(req *http.Request) (*http.Response, error) {
+						deleted = true
+						return CreateResponder(200, ToJson(deleteTask))(req)
+					})
+				RegisterResponder(
+					"GET",
+					server.URL+"/tasks/"+deleteTask.ID,
+					CreateResponder(200, ToJson(deleteCompletedTask)))
+
+				actions = map[string]cpi.ActionFn{
+					"create_vm": CreateVM,
+				}
+				args = []interface{}{
+					"agent-id",
+					"fake-stemcell-id",
+					map[string]interface{}{
+						"vm_flavor":   "fake-flavor",
+						"disk_flavor": "fake-flavor",
+					}, // cloud_properties
+					map[string]interface{}{}, // networks
+					[]string{},               // disk_cids
+					map[string]interface{}{}, // environment
+				}
+			})
+
+			It("should delete the VM and return the original error", func() {
+				res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(res.Result).Should(BeNil())
+				Expect(res.Error).ShouldNot(BeNil())
+				Expect(res.Error.Type).Should(Equal(cpi.CloudError))
+				Expect(res.Error.Message).Should(Equal("Could not find ID for ephemeral disk of new VM fake-vm-id"))
+				Expect(deleted).Should(BeTrue())
+			})
+			It("should report both errors when deleting the VM fails", func() {
+				RegisterResponder(
+					"DELETE",
+					server.URL+"/vms/fake-vm-id",
+					CreateResponder(500, ToJson(ec.ApiError{Code: "InternalError", Message: "fake delete error"})))
+
+				res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(res.Error).ShouldNot(BeNil())
+				Expect(res.Error.Type).Should(Equal(cpi.CloudError))
+				Expect(res.Error.CanRetry).Should(BeFalse())
+				Expect(res.Error.Message).Should(ContainSubstring("Could not find ID for ephemeral disk of new VM fake-vm-id"))
+				Expect(res.Error.Message).Should(ContainSubstring("cleanup of VM fake-vm-id also failed"))
+				Expect(res.Error.Message).Should(ContainSubstring("fake delete error"))
+			})
+			It("should keep the VM when configured to", func() {
+				ctx.Config.Debug = &cpi.DebugConfig{KeepFailedVMs: true}
+
+				res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(res.Error).ShouldNot(BeNil())
+				Expect(res.Error.Type).Should(Equal(cpi.CloudError))
+				Expect(res.Error.Message).Should(ContainSubstring("VM fake-vm-id was kept for debugging"))
+				Expect(deleted).Should(BeFalse())
+			})
+		})
+		It("should return an error when cloud_properties has bad property type", func() {
+			actions := map[string]cpi.ActionFn{
+				"create_vm": CreateVM,
+			}
+			args := []interface{}{
+				"agent-id",
+				"fake-stemcell-id",
+				map[string]interface{}{
+					"vm_flavor":   123,
+					"disk_flavor": "fake-flavor",
+				}, // cloud_properties
+				map[string]interface{}{}, // networks
+				[]string{},               // disk_cids
+				map[string]interface{}{}, // environment
+			}
+			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		It("should return an error when cloud_properties has no properties", func() {
+			actions := map[string]cpi.ActionFn{
+				"create_vm": CreateVM,
+			}
+			args := []interface{}{"agent-id", "fake-stemcell-id", map[string]interface{}{}}
+			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		It("should return an error when cloud_properties is missing", func() {
+			actions := map[string]cpi.ActionFn{
+				"create_vm": CreateVM,
+			}
+			args := []interface{}{"agent-id", "fake-stemcell-id"}
+			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+	})
+
+	Describe("DeleteVM", func() {
+		It("should return nothing when successful", func() {
+			deleteTask := &ec.Task{Operation: "DELETE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			completedTask := &ec.Task{Operation: "DELETE_VM", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+
+			offTask := &ec.Task{Operation: "STOP_VM", State: "QUEUED", ID: "fake-off-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			offCompletedTask := &ec.Task{Operation: "STOP_VM", State: "COMPLETED", ID: "fake-off-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+
+			detachQueuedTask := &ec.Task{Operation: "DETACH_DISK", State: "QUEUED", ID: "fake-disk-task-1", Entity: ec.Entity{ID: "fake-disk-1"}}
+			detachCompletedTask := &ec.Task{Operation: "DETACH_DISK", State: "COMPLETED", ID: "fake-disk-task-1", Entity: ec.Entity{ID: "fake-disk-1"}}
+
+			vm := &ec.VM{
+				ID:    "fake-vm-id",
+				State: "STARTED",
+				AttachedDisks: []ec.AttachedDisk{
+					ec.AttachedDisk{ID: "fake-boot-disk", Kind: "ephemeral-disk"},
+					ec.AttachedDisk{ID: "fake-disk-1", Kind: "persistent-disk"},
+				},
+			}
+
+			RegisterResponder(
+				"GET",
+				server.URL+"/vms/"+deleteTask.Entity.ID,
+				CreateResponder(200, ToJson(vm)))
+			RegisterResponder(
+				"DELETE",
+				server.URL+"/vms/"+deleteTask.Entity.ID,
+				CreateResponder(200, ToJson(deleteTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+"/vms/"+deleteTask.Entity.ID+"/stop",
+				CreateResponder(200, ToJson(offTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+"/vms/"+deleteTask.Entity.ID+"/detach_disk",
+				CreateResponder(200, ToJson(detachQueuedTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+detachCompletedTask.ID,
+				CreateResponder(200, ToJson(detachCompletedTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+deleteTask.ID,
+				CreateResponder(200, ToJson(completedTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+offCompletedTask.ID,
+				CreateResponder(200, ToJson(offCompletedTask)))
+
+			actions := map[string]cpi.ActionFn{
+				"delete_vm": DeleteVM,
+			}
+			args := []interface{}{"fake-vm-id"}
+			res, err := GetResponse(dispatch(ctx, actions, "delete_vm", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).Should(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		It("should detach all persistent disks of the VM", func() {
+			deleteTask := &ec.Task{Operation: "DELETE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			completedTask := &ec.Task{Operation: "DELETE_VM", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			vm := &ec.VM{ID: "fake-vm-id", State: "STOPPED"}
+			for i := 0; i < 10; i++ {
+				vm.AttachedDisks = append(vm.AttachedDisks,
+					ec.AttachedDisk{ID: fmt.Sprintf("fake-disk-%d", i), Kind: "persistent-disk"})
+			}
+
+			var mutex sync.Mutex
+			detached := []string{}
+			RegisterResponder(
+				"GET",
+				server.URL+"/vms/"+deleteTask.Entity.ID,
+				CreateResponder(200, ToJson(vm)))
+			RegisterResponder(
+				"POST",
+				server.URL+"/vms/"+deleteTask.Entity.ID+"/detach_disk",
+				func(req *http.Request) (*http.Response, error) {
+					op := &ec.VmDiskOperation{}
+					json.NewDecoder(req.Body).Decode(op)
+					mutex.Lock()
+					detached = append(detached, op.DiskID)
+					mutex.Unlock()
+					task := &ec.Task{Operation: "DETACH_DISK", State: "COMPLETED", ID: "fake-detach-task-" + op.DiskID}
+					return CreateResponder(200, ToJson(task))(req)
+				})
+			for i := 0; i < 10; i++ {
+				task := &ec.Task{Operation: "DETACH_DISK", State: "COMPLETED", ID: fmt.Sprintf("fake-detach-task-fake-disk-%d", i)}
+				RegisterResponder(
+					"GET",
+					server.URL+"/tasks/"+task.ID,
+					CreateResponder(200, ToJson(task)))
+			}
+			RegisterResponder(
+				"DELETE",
+				server.URL+"/vms/"+deleteTask.Entity.ID,
+				CreateResponder(200, ToJson(deleteTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+deleteTask.ID,
+				CreateResponder(200, ToJson(completedTask)))
+
+			actions := map[string]cpi.ActionFn{
+				"delete_vm": DeleteVM,
+			}
+			args := []interface{}{"fake-vm-id"}
+			res, err := GetResponse(dispatch(ctx, actions, "delete_vm", args))
+
+			Expect(res.Error).Should(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			sort.Strings(detached)
+			expected := []string{}
+			for _, disk := range vm.AttachedDisks {
+				expected = append(expected, disk.ID)
+			}
+			sort.Strings(expected)
+			Expect(detached).Should(Equal(expected))
+		})
+		It("should return an error and not delete the VM when a detach fails", func() {
+			vm := &ec.VM{
+				ID:    "fake-vm-id",
+				State: "STOPPED",
+				AttachedDisks: []ec.AttachedDisk{
+					ec.AttachedDisk{ID: "fake-disk-1", Kind: "persistent-disk"},
+					ec.AttachedDisk{ID: "fake-disk-2", Kind: "persistent-disk"},
+				},
+			}
+			detachTask := &ec.Task{Operation: "DETACH_DISK", State: "ERROR", ID: "fake-detach-task-id"}
+
+			// No responder for delete, so deleting the VM would fail differently
+			RegisterResponder(
+				"GET",
+				server.URL+"/vms/fake-vm-id",
+				CreateResponder(200, ToJson(vm)))
+			RegisterResponder(
+				"POST",
+				server.URL+"/vms/fake-vm-id/detach_disk",
+				CreateResponder(200, ToJson(detachTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+detachTask.ID,
+				CreateResponder(200, ToJson(detachTask)))
+
+			actions := map[string]cpi.ActionFn{
+				"delete_vm": DeleteVM,
+			}
+			args := []interface{}{"fake-vm-id"}
+			res, err := GetResponse(dispatch(ctx, actions, "delete_vm", args))
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.CloudError))
+			Expect(res.Log).Should(ContainSubstring("Failed to detach disk fake-disk-1"))
+			Expect(res.Log).Should(ContainSubstring("Failed to detach disk fake-disk-2"))
+		})
+		It("should not stop a VM that is already stopped", func() {
+			deleteTask := &ec.Task{Operation: "DELETE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			completedTask := &ec.Task{Operation: "DELETE_VM", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			vm := &ec.VM{ID: "fake-vm-id", State: "STOPPED"}
+
+			// No responder for stop, so stopping the VM would fail
+			RegisterResponder(
+				"GET",
+				server.URL+"/vms/"+deleteTask.Entity.ID,
+				CreateResponder(200, ToJson(vm)))
+			RegisterResponder(
+				"DELETE",
+				server.URL+"/vms/"+deleteTask.Entity.ID,
+				CreateResponder(200, ToJson(deleteTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+"/tasks/"+deleteTask.ID,
+				CreateResponder(200, ToJson(completedTask)))
+
+			actions := map[string]cpi.ActionFn{
+				"delete_vm": DeleteVM,
+			}
+			args := []interface{}{"fake-vm-id"}
+			res, err := GetResponse(dispatch(ctx, actions, "delete_vm", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).Should(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).Should(ContainSubstring("VM is already stopped"))
+		})
+		It("should return nothing when VM not found", func() {
+			RegisterResponder(
+				"GET",
+				server.URL+"/vms/fake-vm-id",
+				CreateResponder(404, ToJson(ec.ApiError{Code: "VmNotFound"})))
+
+			actions := map[string]cpi.ActionFn{
+				"delete_vm": DeleteVM,
+			}
+			args := []interface{}{"fake-vm-id"}
+			res, err := GetResponse(dispatch(ctx, actions, "delete_vm", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).Should(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).Should(ContainSubstring("VM 'fake-vm-id' not found, nothing to delete"))
+		})
+		It("should return an error when getting the VM fails", func() {
+			RegisterResponder(
+				"GET",
+				server.URL+"/vms/fake-vm-id",
+				CreateResponder(500, ToJson(ec.ApiError{Code: "InternalError"})))
 
 			actions := map[string]cpi.ActionFn{
 				"delete_vm": DeleteVM,